@@ -0,0 +1,151 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+)
+
+// maxMagicLen is the length of the longest built-in magic
+const maxMagicLen = 3
+
+// Decompressor returns a reader of the decompressed contents of r
+type Decompressor func(r io.Reader) (io.Reader, error)
+
+var (
+	decompressorsLock sync.RWMutex
+	// decompressors maps magic bytes (as a string) to their Decompressor
+	decompressors = make(map[string]Decompressor)
+)
+
+// RegisterDecompressor makes a decompressor available to ExtractArchive for
+// streams starting with the given magic bytes. The built-in gzip and bzip2
+// detection takes precedence; among the registered decompressors the one with
+// the longest matching magic is used. The reader passed to factory still
+// contains the magic bytes.
+// It is safe to call RegisterDecompressor from multiple init functions. If it
+// is called twice with the same magic, the last factory wins.
+func RegisterDecompressor(magic []byte, factory func(io.Reader) (io.Reader, error)) {
+	if len(magic) == 0 {
+		panic("tar: RegisterDecompressor magic is empty")
+	}
+	if factory == nil {
+		panic("tar: RegisterDecompressor factory is nil")
+	}
+	decompressorsLock.Lock()
+	defer decompressorsLock.Unlock()
+	decompressors[string(magic)] = factory
+}
+
+// lookupDecompressor returns the registered decompressor with the longest
+// magic prefixing b, or nil if there is none
+func lookupDecompressor(b []byte) Decompressor {
+	decompressorsLock.RLock()
+	defer decompressorsLock.RUnlock()
+	var (
+		best    Decompressor
+		bestLen int
+	)
+	for magic, d := range decompressors {
+		if len(magic) > bestLen && bytes.HasPrefix(b, []byte(magic)) {
+			best, bestLen = d, len(magic)
+		}
+	}
+	return best
+}
+
+// magicLen returns the number of bytes to peek at to detect the compression
+func magicLen() int {
+	decompressorsLock.RLock()
+	defer decompressorsLock.RUnlock()
+	n := maxMagicLen
+	for magic := range decompressors {
+		if len(magic) > n {
+			n = len(magic)
+		}
+	}
+	return n
+}
+
+// ExtractArchive extracts a tarball, optionally compressed, from r into the
+// given directory. The compression is detected from the magic bytes at the
+// start of the stream; uncompressed tarballs are extracted unchanged.
+// if pwl is not nil, only the paths in the map are extracted.
+func ExtractArchive(r io.Reader, dir string, pwl PathWhitelistMap) error {
+	e := Extractor{Options: ExtractTarOptions{Whitelist: pwl}}
+	return e.ExtractArchive(r, dir)
+}
+
+// ExtractArchiveFile extracts the tarball in the file at path into dir, as
+// configured by opts. The compression is chosen from the extension of path:
+// gzip for ".gz" and ".tgz", bzip2 for ".bz2", ".tbz" and ".tbz2", and none for
+// ".tar". For other extensions, such as ".aci", it is detected from the magic
+// bytes, as by ExtractArchive. With opts.CleanupOnError, a failed extraction
+// leaves no partial tree behind.
+func ExtractArchiveFile(path, dir string, opts ExtractTarOptions) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error extracting archive: %w", err)
+	}
+	defer f.Close()
+	e := Extractor{Options: opts}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".tar":
+		return extractTarStream(f, dir, opts)
+	case ".gz", ".tgz":
+		return e.extractCompressed(f, dir, func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		})
+	case ".bz2", ".tbz", ".tbz2":
+		return e.extractCompressed(f, dir, func(r io.Reader) (io.Reader, error) {
+			return bzip2.NewReader(r), nil
+		})
+	}
+	return e.ExtractArchive(f, dir)
+}
+
+// decompress returns a reader of the decompressed contents of r. The magic
+// bytes are only peeked at, so the returned reader still sees them.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(magicLen())
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return bzip2.NewReader(br), nil
+	}
+	if d := lookupDecompressor(magic); d != nil {
+		return d(br)
+	}
+	return br, nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractArchive(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	plain, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	if _, err := gw.Write(plain); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, b := range [][]byte{plain, gz.Bytes()} {
+		tmpdir, err := ioutil.TempDir("", "rocket-temp-dir")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(tmpdir)
+		if err := ExtractArchive(bytes.NewReader(b), tmpdir, nil); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "folder/foo.txt"))
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if string(buf) != "foo" {
+			t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+		}
+	}
+}
+
+// testBzip2Tar is a tarball of the file folder/foo.txt, of content "foo",
+// compressed with bzip2
+var testBzip2Tar = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0xd7, 0xb8,
+	0x07, 0x14, 0x00, 0x00, 0x6f, 0x7b, 0x80, 0xc9, 0x80, 0x00, 0x00, 0xc0,
+	0x01, 0xef, 0x00, 0x10, 0x00, 0x67, 0x04, 0x9e, 0x40, 0x08, 0x08, 0x20,
+	0x00, 0x54, 0x46, 0xa8, 0xd0, 0x64, 0x7a, 0x98, 0x11, 0x8d, 0x4d, 0xa0,
+	0x92, 0x49, 0xea, 0x32, 0x0d, 0x1a, 0x00, 0x07, 0xdd, 0xdc, 0x41, 0x08,
+	0x39, 0x74, 0x21, 0x19, 0x75, 0x49, 0x14, 0xbe, 0xd8, 0xa0, 0x43, 0x03,
+	0x12, 0x8c, 0xdc, 0x4e, 0xc2, 0x34, 0x80, 0x29, 0x31, 0xe6, 0x73, 0x3d,
+	0xf9, 0x10, 0xbd, 0x66, 0xbf, 0x48, 0x20, 0xba, 0x61, 0x57, 0x0a, 0xf8,
+	0x00, 0x08, 0xb2, 0x2e, 0xe4, 0x8a, 0x70, 0xa1, 0x21, 0xaf, 0x70, 0x0e,
+	0x28,
+}
+
+func TestExtractArchiveBzip2(t *testing.T) {
+	bz := testBzip2Tar
+
+	tmpdir, err := ioutil.TempDir("", "rocket-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractArchive(bytes.NewReader(bz), tmpdir, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "folder/foo.txt"))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if string(buf) != "foo" {
+		t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+	}
+
+	for _, n := range []int{len(bz) - 1, len(bz) / 2} {
+		tmpdir, err := ioutil.TempDir("", "rocket-temp-dir")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(tmpdir)
+		if err := ExtractArchive(bytes.NewReader(bz[:n]), tmpdir, nil); err == nil {
+			t.Errorf("expected error for stream truncated to %d bytes", n)
+		}
+	}
+}
+
+func TestRegisterDecompressor(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	plain, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The test "compression" is a plain tarball behind a magic header
+	magic := []byte("RKTTEST")
+	RegisterDecompressor(magic[:3], func(r io.Reader) (io.Reader, error) {
+		return nil, errors.New("shorter magic should not be used")
+	})
+	RegisterDecompressor(magic, func(r io.Reader) (io.Reader, error) {
+		if _, err := io.ReadFull(r, make([]byte, len(magic))); err != nil {
+			return nil, err
+		}
+		return r, nil
+	})
+
+	tmpdir, err := ioutil.TempDir("", "rocket-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	b := append(append([]byte{}, magic...), plain...)
+	if err := ExtractArchive(bytes.NewReader(b), tmpdir, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "folder/foo.txt"))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if string(buf) != "foo" {
+		t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+	}
+}
+
+func TestExtractArchiveFile(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	plain, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	if _, err := gw.Write(plain); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	files := newTestDir(t)
+	defer os.RemoveAll(files)
+	tests := []struct {
+		name string
+		b    []byte
+		ok   bool
+	}{
+		{"layer.tar", plain, true},
+		{"layer.tar.gz", gz.Bytes(), true},
+		{"layer.TGZ", gz.Bytes(), true},
+		// Detected from the magic bytes
+		{"image.aci", gz.Bytes(), true},
+		{"image.aci", plain, true},
+		{"plain.tar.gz", plain, false},
+		{"compressed.tar", gz.Bytes(), false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(files, tt.name)
+		if err := ioutil.WriteFile(path, tt.b, 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		err := ExtractArchiveFile(path, tmpdir, ExtractTarOptions{})
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "folder/foo.txt"))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		} else if string(buf) != "foo" {
+			t.Errorf("%s: unexpected contents, wanted: %s, got: %s", tt.name, "foo", buf)
+		}
+	}
+
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractArchiveFile(filepath.Join(files, "missing.tar"), tmpdir, ExtractTarOptions{}); !os.IsNotExist(errors.Unwrap(err)) {
+		t.Errorf("expected a not found error, got: %v", err)
+	}
+}
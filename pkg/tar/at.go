@@ -0,0 +1,323 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	oPath       = 0x200000
+	atRemovedir = 0x200
+)
+
+// ExtractTarAt is like ExtractTarWithOptions, but extracts into the directory
+// open as rootFd, which it does not close. Every path is resolved from rootFd
+// one component at a time, never following symlinks nor "..", so that the
+// kernel itself keeps the extraction within the directory, whatever was
+// extracted before. It has the restrictions of ExtractTarFS.
+func ExtractTarAt(rootFd int, tr *tar.Reader, opts ExtractTarOptions) error {
+	return ExtractTarFS(atFilesystem{rootFd}, tr, ".", opts)
+}
+
+// atFilesystem is the Filesystem of the directory open as root, whose names
+// are relative to it
+type atFilesystem struct {
+	root int
+}
+
+// resolve opens the parent directory of name, which the caller must close
+// with closeParent, and returns it with the last component of name
+func (fs atFilesystem) resolve(name string) (int, string, error) {
+	name = filepath.Clean(name)
+	if filepath.IsAbs(name) || escapesRoot(name) {
+		return -1, "", fmt.Errorf("%w %q", ErrPathEscape, name)
+	}
+	fd := fs.root
+	components := strings.Split(name, "/")
+	for _, c := range components[:len(components)-1] {
+		next, err := syscall.Openat(fd, c, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		fs.closeParent(fd)
+		if err != nil {
+			return -1, "", &os.PathError{Op: "openat", Path: name, Err: err}
+		}
+		fd = next
+	}
+	return fd, components[len(components)-1], nil
+}
+
+func (fs atFilesystem) closeParent(fd int) {
+	if fd != fs.root {
+		syscall.Close(fd)
+	}
+}
+
+func (fs atFilesystem) Mkdir(name string, perm os.FileMode) error {
+	fd, base, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	defer fs.closeParent(fd)
+	if err := syscall.Mkdirat(fd, base, uint32(perm.Perm())); err != nil {
+		return &os.PathError{Op: "mkdirat", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (fs atFilesystem) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	fd, base, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.closeParent(fd)
+	f, err := syscall.Openat(fd, base, syscall.O_CREAT|syscall.O_WRONLY|syscall.O_TRUNC|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(f), name), nil
+}
+
+func (fs atFilesystem) Symlink(oldname, newname string) error {
+	fd, base, err := fs.resolve(newname)
+	if err != nil {
+		return err
+	}
+	defer fs.closeParent(fd)
+	if err := symlinkat(oldname, fd, base); err != nil {
+		return &os.LinkError{Op: "symlinkat", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (fs atFilesystem) Link(oldname, newname string) error {
+	oldFd, oldBase, err := fs.resolve(oldname)
+	if err != nil {
+		return err
+	}
+	defer fs.closeParent(oldFd)
+	newFd, newBase, err := fs.resolve(newname)
+	if err != nil {
+		return err
+	}
+	defer fs.closeParent(newFd)
+	if err := linkat(oldFd, oldBase, newFd, newBase); err != nil {
+		return &os.LinkError{Op: "linkat", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+// Chmod follows a symlink at name, as fchmodat cannot do otherwise, so it
+// fails on them instead
+func (fs atFilesystem) Chmod(name string, mode os.FileMode) error {
+	fi, err := fs.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return &os.PathError{Op: "fchmodat", Path: name, Err: syscall.ELOOP}
+	}
+	fd, base, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	defer fs.closeParent(fd)
+	if err := syscall.Fchmodat(fd, base, syscallMode(mode), 0); err != nil {
+		return &os.PathError{Op: "fchmodat", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (fs atFilesystem) Chown(name string, uid, gid int) error {
+	fd, base, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	defer fs.closeParent(fd)
+	if err := syscall.Fchownat(fd, base, uid, gid, atSymlinkNofollow); err != nil {
+		return &os.PathError{Op: "fchownat", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (fs atFilesystem) Chtimes(name string, atime, mtime time.Time) error {
+	fd, base, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	defer fs.closeParent(fd)
+	if err := utimensat(fd, base, atime, mtime); err != nil {
+		return &os.PathError{Op: "utimensat", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (fs atFilesystem) Lstat(name string) (os.FileInfo, error) {
+	fd, base, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.closeParent(fd)
+	f, err := syscall.Openat(fd, base, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: name, Err: err}
+	}
+	defer syscall.Close(f)
+	fi := &statInfo{name: filepath.Base(name)}
+	if err := syscall.Fstat(f, &fi.st); err != nil {
+		return nil, &os.PathError{Op: "fstat", Path: name, Err: err}
+	}
+	return fi, nil
+}
+
+func (fs atFilesystem) Remove(name string) error {
+	fd, base, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	defer fs.closeParent(fd)
+	err = unlinkat(fd, base, 0)
+	if err == syscall.EISDIR {
+		err = unlinkat(fd, base, atRemovedir)
+	}
+	if err != nil {
+		return &os.PathError{Op: "unlinkat", Path: name, Err: err}
+	}
+	return nil
+}
+
+// statInfo is the os.FileInfo of a syscall.Stat_t
+type statInfo struct {
+	name string
+	st   syscall.Stat_t
+}
+
+func (fi *statInfo) Name() string       { return fi.name }
+func (fi *statInfo) Size() int64        { return fi.st.Size }
+func (fi *statInfo) ModTime() time.Time { return time.Unix(fi.st.Mtim.Unix()) }
+func (fi *statInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *statInfo) Sys() interface{}   { return &fi.st }
+
+func (fi *statInfo) Mode() os.FileMode {
+	mode := os.FileMode(fi.st.Mode & 0777)
+	switch fi.st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	}
+	if fi.st.Mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if fi.st.Mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if fi.st.Mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// syscallMode returns the permission bits of mode, with the setuid, setgid
+// and sticky bits, as the kernel expects them
+func syscallMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+	return m
+}
+
+func symlinkat(target string, fd int, name string) error {
+	t, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_SYMLINKAT, uintptr(unsafe.Pointer(t)), uintptr(fd), uintptr(unsafe.Pointer(n)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func linkat(oldFd int, oldName string, newFd int, newName string) error {
+	o, err := syscall.BytePtrFromString(oldName)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(newName)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT, uintptr(oldFd), uintptr(unsafe.Pointer(o)), uintptr(newFd), uintptr(unsafe.Pointer(n)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func unlinkat(fd int, name string, flags int) error {
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_UNLINKAT, uintptr(fd), uintptr(unsafe.Pointer(n)), uintptr(flags))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// utimensat is like lutimes, relative to the directory open as fd
+func utimensat(fd int, name string, atime, mtime time.Time) error {
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	ts := [2]syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(fd), uintptr(unsafe.Pointer(n)), uintptr(unsafe.Pointer(&ts)), atSymlinkNofollow, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
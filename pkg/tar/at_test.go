@@ -0,0 +1,117 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestExtractTarAt(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: int64(0640),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/bar.txt",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder/foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "etc",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "/etc",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0750),
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	root, err := syscall.Open(tmpdir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer syscall.Close(root)
+	if err := ExtractTarAt(root, newTestTarReader(t, entries), ExtractTarOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"folder/foo.txt", "folder/bar.txt"} {
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf) != "foo" {
+			t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+		}
+	}
+	fi, err := os.Stat(filepath.Join(tmpdir, "folder"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi.Mode() != os.ModeDir|0750 {
+		t.Errorf("unexpected mode %v, wanted %v", fi.Mode(), os.ModeDir|0750)
+	}
+	if target, err := os.Readlink(filepath.Join(tmpdir, "etc")); err != nil || target != "/etc" {
+		t.Errorf("unexpected symlink target %q: %v", target, err)
+	}
+
+	// Nothing is written through the symlink extracted before
+	entries = []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "etc/rkt-test",
+				Size: 3,
+			},
+		},
+	}
+	err = ExtractTarAt(root, newTestTarReader(t, entries), ExtractTarOptions{})
+	if !errors.Is(err, ErrInsecureLink) {
+		t.Errorf("expected ErrInsecureLink, got: %v", err)
+	}
+	if _, err := os.Lstat("/etc/rkt-test"); err == nil {
+		os.Remove("/etc/rkt-test")
+		t.Errorf("file extracted through symlink")
+	}
+
+	// Neither are the paths resolved at the syscall level
+	fs := atFilesystem{root}
+	if _, err := fs.Create("etc/rkt-test", 0644); err == nil {
+		os.Remove("/etc/rkt-test")
+		t.Errorf("file created through symlink")
+	}
+	if err := fs.Mkdir("../rkt-test", 0755); !errors.Is(err, ErrPathEscape) {
+		t.Errorf("expected ErrPathEscape, got: %v", err)
+	}
+}
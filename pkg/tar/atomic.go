@@ -0,0 +1,81 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ExtractTarAtomic extracts a tarball (from a tar.Reader) into finalDir, as
+// configured by opts, so that finalDir either holds the whole tarball or is
+// left untouched. The tarball is extracted into a temporary directory next to
+// finalDir, and thus on the same filesystem, which is renamed to finalDir once
+// the extraction succeeds and removed otherwise.
+// If finalDir already exists, ExtractTarAtomic fails unless opts.ReplaceDir
+// is set, in which case the old directory is removed once replaced.
+func ExtractTarAtomic(tr *tar.Reader, finalDir string, opts ExtractTarOptions) error {
+	finalDir = filepath.Clean(finalDir)
+	if _, err := os.Lstat(finalDir); err == nil && !opts.ReplaceDir {
+		return fmt.Errorf("error extracting tarball: %q already exists", finalDir)
+	}
+	tmpdir, err := ioutil.TempDir(filepath.Dir(finalDir), "."+filepath.Base(finalDir)+"-")
+	if err != nil {
+		return fmt.Errorf("error creating temporary directory: %w", err)
+	}
+	if err := os.Chmod(tmpdir, DEFAULT_DIR_MODE); err != nil {
+		os.RemoveAll(tmpdir)
+		return fmt.Errorf("error creating temporary directory: %w", err)
+	}
+	if err := ExtractTarWithOptions(tr, tmpdir, opts); err != nil {
+		os.RemoveAll(tmpdir)
+		return err
+	}
+	if err := replaceDir(tmpdir, finalDir); err != nil {
+		os.RemoveAll(tmpdir)
+		return fmt.Errorf("error moving extracted tarball into place: %w", err)
+	}
+	return nil
+}
+
+// replaceDir renames src to dst, removing what existed at dst. Both must be on
+// the same filesystem.
+func replaceDir(src, dst string) error {
+	if _, err := os.Lstat(dst); os.IsNotExist(err) {
+		return os.Rename(src, dst)
+	}
+	// Move what exists at dst out of the way first, so it can be restored
+	// if src cannot be moved into place
+	old, err := ioutil.TempDir(filepath.Dir(dst), "."+filepath.Base(dst)+"-old-")
+	if err != nil {
+		return err
+	}
+	oldDst := filepath.Join(old, filepath.Base(dst))
+	if err := os.Rename(dst, oldDst); err != nil {
+		os.Remove(old)
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		if rerr := os.Rename(oldDst, dst); rerr != nil {
+			return fmt.Errorf("%v (and restoring %q from %q failed: %v)", err, dst, oldDst, rerr)
+		}
+		os.Remove(old)
+		return err
+	}
+	return os.RemoveAll(old)
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractTarAtomic(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	insecureEntries := append(entries, &testTarEntry{
+		header: &tar.Header{
+			Name:     "secret.conf",
+			Linkname: "../../etc/secret.conf",
+			Typeflag: tar.TypeSymlink,
+		},
+	})
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	finalDir := filepath.Join(tmpdir, "rootfs")
+
+	// A failed extraction leaves nothing behind
+	if err := ExtractTarAtomic(newTestTarReader(t, insecureEntries), finalDir, ExtractTarOptions{}); err == nil {
+		t.Errorf("expected error")
+	}
+	if infos, err := ioutil.ReadDir(tmpdir); err != nil || len(infos) != 0 {
+		t.Errorf("unexpected leftovers: %v (err: %v)", infos, err)
+	}
+
+	if err := ExtractTarAtomic(newTestTarReader(t, entries), finalDir, ExtractTarOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(finalDir, "foo.txt")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	entries[0].header.Name = "bar.txt"
+	if err := ExtractTarAtomic(newTestTarReader(t, entries), finalDir, ExtractTarOptions{}); err == nil {
+		t.Errorf("expected error for existing directory")
+	}
+	opts := ExtractTarOptions{ReplaceDir: true}
+	if err := ExtractTarAtomic(newTestTarReader(t, entries), finalDir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(finalDir, "bar.txt")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(finalDir, "foo.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected old directory to be replaced")
+	}
+	if infos, err := ioutil.ReadDir(tmpdir); err != nil || len(infos) != 1 {
+		t.Errorf("unexpected leftovers: %v (err: %v)", infos, err)
+	}
+}
+
+func TestExtractTarAtomicRelative(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Chdir(tmpdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Chdir(wd)
+	tr := newTestTarReader(t, entries)
+	// The temporary directory is created next to finalDir, not in $TMPDIR
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", filepath.Join(tmpdir, "missing"))
+
+	if err := ExtractTarAtomic(tr, "rootfs", ExtractTarOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tmpdir, "rootfs/foo.txt")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
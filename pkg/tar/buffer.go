@@ -0,0 +1,48 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// writerPools maps buffer sizes to the sync.Pool of the buffered writers of
+// that size
+var writerPools sync.Map
+
+// getWriter returns a writer buffering the writes to w in size bytes, to be
+// returned with putWriter once flushed
+func getWriter(w io.Writer, size int) *bufio.Writer {
+	if p, ok := writerPools.Load(size); ok {
+		if bw, ok := p.(*sync.Pool).Get().(*bufio.Writer); ok {
+			bw.Reset(w)
+			return bw
+		}
+	}
+	return bufio.NewWriterSize(w, size)
+}
+
+// putWriter makes bw available to getWriter
+func putWriter(bw *bufio.Writer) {
+	// Drop the reference to the writer and any unflushed content
+	bw.Reset(nil)
+	p, ok := writerPools.Load(bw.Size())
+	if !ok {
+		p, _ = writerPools.LoadOrStore(bw.Size(), &sync.Pool{})
+	}
+	p.(*sync.Pool).Put(bw)
+}
@@ -0,0 +1,209 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const blockSize = 512
+
+// contentSkipper reads an uncompressed tarball from r, dropping the content
+// of the entries having none for archive/tar, such as directories and links,
+// which some archivers write with a nonzero size anyway. archive/tar would
+// otherwise read that content as the next header.
+// Blocks it cannot make sense of end the inspection; they are passed through
+// for archive/tar to report.
+type contentSkipper struct {
+	r     io.Reader
+	block [blockSize]byte
+	// buf is the part of the current header block not read yet
+	buf []byte
+	// remain is the number of bytes of content, and padding, to pass through
+	remain int64
+	// ext is whether the next block is a GNU sparse extension header
+	ext bool
+	// pax collects the content of a PAX header, of paxLen bytes
+	pax    *bytes.Buffer
+	paxLen int64
+	// paxSize, if not negative, is the size PAX records set for the next
+	// entry
+	paxSize int64
+	// raw is whether the inspection ended
+	raw bool
+	err error
+}
+
+func newContentSkipper(r io.Reader) *contentSkipper {
+	return &contentSkipper{r: r, paxSize: -1}
+}
+
+func (s *contentSkipper) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 && s.remain == 0 && !s.raw && s.err == nil {
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	if len(s.buf) > 0 {
+		n := copy(p, s.buf)
+		s.buf = s.buf[n:]
+		return n, nil
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.raw {
+		return s.r.Read(p)
+	}
+	if int64(len(p)) > s.remain {
+		p = p[:s.remain]
+	}
+	n, err := s.r.Read(p)
+	s.remain -= int64(n)
+	if s.pax != nil {
+		s.pax.Write(p[:n])
+		if s.remain == 0 {
+			s.paxSize = paxSize(s.pax.Bytes()[:s.paxLen])
+			s.pax = nil
+		}
+	}
+	return n, err
+}
+
+// next reads the next header block and works out the length of the content
+// following it
+func (s *contentSkipper) next() error {
+	n, err := io.ReadFull(s.r, s.block[:])
+	s.buf = s.block[:n]
+	if err != nil {
+		s.raw = true
+		if n == 0 {
+			return err
+		}
+		return nil
+	}
+	if s.ext {
+		s.ext = s.block[504] != 0
+		return nil
+	}
+	if isZero(s.block[:]) || !validChecksum(s.block[:]) {
+		s.raw = true
+		return nil
+	}
+	size, ok := parseNumeric(s.block[124:136])
+	if !ok {
+		s.raw = true
+		return nil
+	}
+	typ := s.block[156]
+	switch typ {
+	case 'x':
+		s.pax = new(bytes.Buffer)
+		s.paxLen = size
+	case 'g', 'L', 'K':
+	default:
+		if s.paxSize >= 0 {
+			size = s.paxSize
+			s.paxSize = -1
+		}
+	}
+	switch typ {
+	case 'S':
+		// Only the GNU format has an isextended flag
+		s.ext = string(s.block[257:265]) == "ustar  \x00" && s.block[482] != 0
+	case '1', '2', '3', '4', '5', '6':
+		if _, err := io.CopyN(ioutil.Discard, s.r, padded(size)); err != nil {
+			s.err = io.ErrUnexpectedEOF
+		}
+		size = 0
+	}
+	s.remain = padded(size)
+	return nil
+}
+
+// padded returns size rounded up to a multiple of blockSize
+func padded(size int64) int64 {
+	return (size + blockSize - 1) / blockSize * blockSize
+}
+
+// validChecksum returns whether the checksum of the header block b is valid,
+// computed with either unsigned or signed bytes
+func validChecksum(b []byte) bool {
+	want, ok := parseNumeric(b[148:156])
+	if !ok {
+		return false
+	}
+	var unsigned, signed int64
+	for i, c := range b {
+		if i >= 148 && i < 156 {
+			c = ' '
+		}
+		unsigned += int64(c)
+		signed += int64(int8(c))
+	}
+	return want == unsigned || want == signed
+}
+
+// parseNumeric parses a numeric field of a header, in octal or, as GNU tar
+// writes large values, base-256
+func parseNumeric(b []byte) (int64, bool) {
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		if b[0]&0x40 != 0 {
+			// Negative
+			return 0, false
+		}
+		v := int64(b[0] & 0x3f)
+		for _, c := range b[1:] {
+			if v > (1<<63-1)>>8 {
+				return 0, false
+			}
+			v = v<<8 | int64(c)
+		}
+		return v, true
+	}
+	s := strings.Trim(string(b), " \x00")
+	if s == "" {
+		return 0, true
+	}
+	v, err := strconv.ParseInt(s, 8, 64)
+	return v, err == nil && v >= 0
+}
+
+// paxSize returns the size set by the PAX records in b, or -1 if none does
+func paxSize(b []byte) int64 {
+	size := int64(-1)
+	for len(b) > 0 {
+		sp := bytes.IndexByte(b, ' ')
+		if sp < 0 {
+			break
+		}
+		n, err := strconv.Atoi(string(b[:sp]))
+		if err != nil || n <= sp || n > len(b) {
+			break
+		}
+		rec := strings.TrimSuffix(string(b[sp+1:n]), "\n")
+		if strings.HasPrefix(rec, "size=") {
+			if v, err := strconv.ParseInt(rec[len("size="):], 10, 64); err == nil && v >= 0 {
+				size = v
+			}
+		}
+		b = b[n:]
+	}
+	return size
+}
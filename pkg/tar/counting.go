@@ -0,0 +1,87 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+)
+
+// CountingTarReader is a tar.Reader keeping track of the offset of the
+// current entry in the uncompressed stream. Its Next method must be used
+// instead of the one of the embedded tar.Reader.
+type CountingTarReader struct {
+	*tar.Reader
+	cr     *countingReader
+	offset int64
+}
+
+// NewCountingTarReader returns a CountingTarReader reading the uncompressed
+// tarball from r
+func NewCountingTarReader(r io.Reader) *CountingTarReader {
+	return newCountingTarReader(r, false)
+}
+
+// newCountingTarReader is like NewCountingTarReader, but also skips the
+// content of directories and links, as ExtractTarReader does, if skipContent
+// is set
+func newCountingTarReader(r io.Reader, skipContent bool) *CountingTarReader {
+	cr := &countingReader{r: r}
+	var tr *tar.Reader
+	if skipContent {
+		tr = tar.NewReader(newContentSkipper(cr))
+	} else {
+		tr = tar.NewReader(cr)
+	}
+	return &CountingTarReader{Reader: tr, cr: cr}
+}
+
+// Next advances to the next entry, like tar.Reader.Next. The content of the
+// current entry left unread is read, rather than skipped.
+func (ctr *CountingTarReader) Next() (*tar.Header, error) {
+	if _, err := io.Copy(ioutil.Discard, ctr.Reader); err != nil {
+		return nil, err
+	}
+	// The content is padded to the next block, where the headers of the
+	// next entry start
+	ctr.offset = padded(ctr.cr.n)
+	return ctr.Reader.Next()
+}
+
+// CurrentOffset returns the offset of the first header of the current entry,
+// or of the next one to read if Next failed
+func (ctr *CountingTarReader) CurrentOffset() int64 {
+	return ctr.offset
+}
+
+// endMarker returns whether the end-of-archive marker was read after the last
+// entry, once Next returned io.EOF. archive/tar reads both of its blocks, but
+// also returns io.EOF when the stream ends before them.
+func (ctr *CountingTarReader) endMarker() bool {
+	return ctr.cr.n-ctr.offset >= 2*blockSize
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
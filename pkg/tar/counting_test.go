@@ -0,0 +1,112 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCountingTarReader(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: strings.Repeat("x", 600),
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 600,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "bar.txt",
+				Size: 3,
+				PAXRecords: map[string]string{
+					"comment": "a PAX header of its own",
+				},
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "baz",
+				Typeflag: tar.TypeDir,
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctr := NewCountingTarReader(bytes.NewReader(b))
+	var offsets []int64
+	for i := 0; ; i++ {
+		if _, err := ctr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		offsets = append(offsets, ctr.CurrentOffset())
+		// Only some of the content is read
+		if i == 0 {
+			if _, err := ctr.Read(make([]byte, 10)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+	if want := []int64{0, 1536, 3584}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("unexpected offsets %v, wanted %v", offsets, want)
+	}
+}
+
+func TestExtractTarReaderOffsets(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: strings.Repeat("x", 600),
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 600,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "../bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	err = ExtractTarReader(bytes.NewReader(b), tmpdir, ExtractTarOptions{})
+	if err == nil || !strings.HasPrefix(err.Error(), `error at entry "../bar.txt" (offset 1536): `) {
+		t.Errorf("expected error giving the offset, got: %v", err)
+	}
+
+	// Corrupt the header of the second entry
+	b[1536+148] ^= 1
+	err = ExtractTarReader(bytes.NewReader(b), tmpdir, ExtractTarOptions{Overwrite: OverwriteExisting})
+	if err == nil || !strings.Contains(err.Error(), "at offset 1536") {
+		t.Errorf("expected error giving the offset, got: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// CreateTarOptions controls the behavior of CreateTarFromDir
+type CreateTarOptions struct {
+	// FollowSymlinks archives the files symlinks point to instead of the
+	// symlinks themselves.
+	FollowSymlinks bool
+	// Prefix is prepended to the path of every entry, for example
+	// "rootfs/". It is used as is, so directories need a trailing slash.
+	Prefix string
+	// ZeroTimes sets the modification time of every entry to the Unix
+	// epoch, to make the tarball only depend on the contents of dir.
+	ZeroTimes bool
+}
+
+// CreateTarFromDir writes a tarball of the contents of dir to w. Entries are
+// written in lexical order, and their access and change times are left out,
+// so that the same tree always produces the same tarball.
+func CreateTarFromDir(w io.Writer, dir string, opts CreateTarOptions) error {
+	tw := tar.NewWriter(w)
+	c := &tarCreator{
+		tw:      tw,
+		opts:    opts,
+		visited: make(map[devIno]struct{}),
+	}
+	if err := c.addDir(dir, ""); err != nil {
+		return fmt.Errorf("error creating tarball: %w", err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("error creating tarball: %w", err)
+	}
+	return nil
+}
+
+type devIno struct {
+	dev, ino uint64
+}
+
+type tarCreator struct {
+	tw   *tar.Writer
+	opts CreateTarOptions
+	// visited are the directories being archived, to detect symlink loops
+	// when following symlinks
+	visited map[devIno]struct{}
+}
+
+// addDir adds the entries of the directory at path, named name (relative to
+// the root of the tarball) to the tarball
+func (c *tarCreator) addDir(path, name string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		id := devIno{uint64(st.Dev), uint64(st.Ino)}
+		if _, ok := c.visited[id]; ok {
+			return fmt.Errorf("symlink loop at %q", path)
+		}
+		c.visited[id] = struct{}{}
+		defer delete(c.visited, id)
+	}
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		if err := c.add(filepath.Join(path, fi.Name()), filepath.Join(name, fi.Name()), fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add adds the file at path, described by fi and named name, to the tarball
+func (c *tarCreator) add(path, name string, fi os.FileInfo) error {
+	var (
+		link string
+		err  error
+	)
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if c.opts.FollowSymlinks {
+			fi, err = os.Stat(path)
+		} else {
+			link, err = os.Readlink(path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return fmt.Errorf("%q: %v", path, err)
+	}
+	hdr.Name = c.opts.Prefix + name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	if c.opts.ZeroTimes {
+		hdr.ModTime = time.Unix(0, 0)
+	}
+	if err := c.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	switch {
+	case fi.IsDir():
+		return c.addDir(path, name)
+	case fi.Mode().IsRegular():
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(c.tw, f, hdr.Size)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateTarFromDir(t *testing.T) {
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := os.MkdirAll(filepath.Join(tmpdir, "folder"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"folder/foo.txt", "bar.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(tmpdir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := os.Symlink("folder/foo.txt", filepath.Join(tmpdir, "link.txt")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		opts  CreateTarOptions
+		names []string
+		types []byte
+	}{
+		{
+			CreateTarOptions{ZeroTimes: true},
+			[]string{"bar.txt", "folder/", "folder/foo.txt", "link.txt"},
+			[]byte{tar.TypeReg, tar.TypeDir, tar.TypeReg, tar.TypeSymlink},
+		},
+		{
+			CreateTarOptions{FollowSymlinks: true, Prefix: "rootfs/", ZeroTimes: true},
+			[]string{"rootfs/bar.txt", "rootfs/folder/", "rootfs/folder/foo.txt", "rootfs/link.txt"},
+			[]byte{tar.TypeReg, tar.TypeDir, tar.TypeReg, tar.TypeReg},
+		},
+	}
+	for i, tt := range tests {
+		var b, b2 bytes.Buffer
+		if err := CreateTarFromDir(&b, tmpdir, tt.opts); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if err := CreateTarFromDir(&b2, tmpdir, tt.opts); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if !bytes.Equal(b.Bytes(), b2.Bytes()) {
+			t.Errorf("#%d: tarballs of the same directory differ", i)
+		}
+
+		tr := tar.NewReader(&b)
+		for j := 0; ; j++ {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				if j != len(tt.names) {
+					t.Errorf("#%d: unexpected number of entries: %d, wanted %d", i, j, len(tt.names))
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("#%d: unexpected error: %v", i, err)
+			}
+			if j >= len(tt.names) {
+				t.Errorf("#%d: unexpected entry %q", i, hdr.Name)
+				continue
+			}
+			if hdr.Name != tt.names[j] || hdr.Typeflag != tt.types[j] {
+				t.Errorf("#%d: unexpected entry %q of type %c, wanted %q of type %c", i, hdr.Name, hdr.Typeflag, tt.names[j], tt.types[j])
+			}
+			if !hdr.ModTime.Equal(time.Unix(0, 0)) {
+				t.Errorf("#%d: unexpected mtime %v", i, hdr.ModTime)
+			}
+		}
+	}
+}
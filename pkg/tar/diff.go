@@ -0,0 +1,133 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+)
+
+// DiffKind says how an entry changed between two tarballs
+type DiffKind int
+
+const (
+	// DiffAdded is for entries only in the second tarball
+	DiffAdded DiffKind = iota
+	// DiffRemoved is for entries only in the first tarball
+	DiffRemoved
+	// DiffModified is for entries whose type, size, mode, link target or
+	// content changed
+	DiffModified
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case DiffAdded:
+		return "added"
+	case DiffRemoved:
+		return "removed"
+	case DiffModified:
+		return "modified"
+	}
+	return fmt.Sprintf("DiffKind(%d)", int(k))
+}
+
+// DiffEntry describes an entry that changed between two tarballs
+type DiffEntry struct {
+	// Path is the cleaned path of the entry, relative to the root of the
+	// tarballs
+	Path string
+	Kind DiffKind
+}
+
+// diffSummary is what is compared of an entry
+type diffSummary struct {
+	typ      byte
+	size     int64
+	mode     int64
+	linkname string
+	hash     [sha256.Size]byte
+}
+
+// TarDiff returns the entries that changed from a to b, sorted by path. Both
+// tarballs are read to the end, keeping only a summary of each entry in
+// memory. When a path appears more than once in a tarball, its last entry is
+// compared, as it is the one an extraction leaves.
+func TarDiff(a, b *tar.Reader) ([]DiffEntry, error) {
+	sa, err := summarize(a)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := summarize(b)
+	if err != nil {
+		return nil, err
+	}
+	var diff []DiffEntry
+	for name, s := range sb {
+		old, ok := sa[name]
+		switch {
+		case !ok:
+			diff = append(diff, DiffEntry{name, DiffAdded})
+		case old != s:
+			diff = append(diff, DiffEntry{name, DiffModified})
+		}
+	}
+	for name := range sa {
+		if _, ok := sb[name]; !ok {
+			diff = append(diff, DiffEntry{name, DiffRemoved})
+		}
+	}
+	sort.Slice(diff, func(i, j int) bool {
+		return diff[i].Path < diff[j].Path
+	})
+	return diff, nil
+}
+
+// summarize reads the tarball from tr and returns the summaries of its
+// entries by cleaned path
+func summarize(tr *tar.Reader) (map[string]diffSummary, error) {
+	summaries := make(map[string]diffSummary)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return summaries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading tarball: %w", err)
+		}
+		s := diffSummary{
+			typ:      hdr.Typeflag,
+			size:     hdr.Size,
+			mode:     hdr.Mode,
+			linkname: hdr.Linkname,
+		}
+		if isRegular(hdr.Typeflag) {
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, fmt.Errorf("error reading tarball: %w", err)
+			}
+			copy(s.hash[:], h.Sum(nil))
+		}
+		// Both regular file types are the same
+		if s.typ == tar.TypeRegA {
+			s.typ = tar.TypeReg
+		}
+		summaries[filepath.Clean(hdr.Name)] = s
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"testing"
+)
+
+func TestTarDiff(t *testing.T) {
+	a := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			contents: "baz",
+			header: &tar.Header{
+				Name: "folder/baz.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+		{
+			contents: "removed",
+			header: &tar.Header{
+				Name: "removed.txt",
+				Size: 7,
+			},
+		},
+	}
+	b := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "./folder/foo.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		// Same size and mode, different content
+		{
+			contents: "BAR",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			contents: "baz",
+			header: &tar.Header{
+				Name: "folder/baz.txt",
+				Size: 3,
+				Mode: int64(0600),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "bar.txt",
+			},
+		},
+		{
+			contents: "added",
+			header: &tar.Header{
+				Name: "added.txt",
+				Size: 5,
+			},
+		},
+	}
+	diff, err := TarDiff(newTestTarReader(t, a), newTestTarReader(t, b))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []DiffEntry{
+		{"added.txt", DiffAdded},
+		{"folder/bar.txt", DiffModified},
+		{"folder/baz.txt", DiffModified},
+		{"folder/link", DiffModified},
+		{"removed.txt", DiffRemoved},
+	}
+	if len(diff) != len(want) {
+		t.Fatalf("unexpected diff %v, wanted %v", diff, want)
+	}
+	for i := range want {
+		if diff[i] != want[i] {
+			t.Errorf("unexpected entry %v, wanted %v", diff[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Extractor extracts tarballs, one at a time, with the same options. The
+// callbacks and Stats of the options are shared by all of the extractions.
+type Extractor struct {
+	Options ExtractTarOptions
+}
+
+// Extract extracts a tarball (from a tar.Reader) into the given directory
+func (e *Extractor) Extract(tr *tar.Reader, dir string) error {
+	return extractTar(context.Background(), tr, dir, e.Options, nil)
+}
+
+// ExtractArchive extracts a tarball, optionally compressed, from r into the
+// given directory, like the package level ExtractArchive. Like with
+// ExtractTarReader, the content of directories and links is skipped.
+func (e *Extractor) ExtractArchive(r io.Reader, dir string) error {
+	return e.extractCompressed(r, dir, decompress)
+}
+
+// extractCompressed extracts the tarball read from the stream decompress
+// returns for r into dir
+func (e *Extractor) extractCompressed(r io.Reader, dir string, decompress Decompressor) error {
+	dr, err := decompress(r)
+	if err != nil {
+		return fmt.Errorf("error extracting archive: %w", err)
+	}
+	if err := extractTarStream(dr, dir, e.Options); err != nil {
+		return err
+	}
+	// The tar reader stops at the end-of-archive marker, so drain the rest
+	// of the stream to let the decompressor verify its trailer and catch
+	// truncated archives.
+	if _, err := io.Copy(ioutil.Discard, dr); err != nil {
+		return fmt.Errorf("error extracting archive: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractor(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	plain, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	if _, err := gw.Write(plain); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var stats ExtractStats
+	e := &Extractor{
+		Options: ExtractTarOptions{
+			Whitelist: GlobWhitelist{"folder/foo.txt"},
+			Stats:     &stats,
+		},
+	}
+	extract := []func(dir string) error{
+		func(dir string) error {
+			return e.Extract(tar.NewReader(bytes.NewReader(plain)), dir)
+		},
+		func(dir string) error {
+			return e.ExtractArchive(bytes.NewReader(gz.Bytes()), dir)
+		},
+	}
+	for i, f := range extract {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		if err := f(tmpdir); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "folder/foo.txt"))
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if string(buf) != "foo" {
+			t.Errorf("#%d: unexpected contents, wanted: %s, got: %s", i, "foo", buf)
+		}
+		if _, err := os.Lstat(filepath.Join(tmpdir, "folder/bar.txt")); !os.IsNotExist(err) {
+			t.Errorf("#%d: expected folder/bar.txt not to exist, got: %v", i, err)
+		}
+	}
+	if stats.FileCount != 2 || stats.SkippedCount != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
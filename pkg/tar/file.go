@@ -0,0 +1,209 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinkHops is the number of symlinks ExtractFileFromTarFollow follows
+// before assuming a loop
+const maxSymlinkHops = 16
+
+// ExtractFileFromTarFollow is like ExtractFileFromTar, but if file is a
+// symlink to a path inside the tarball, it returns the contents of the target
+// instead. Since the target may come before the link, the tarball is scanned
+// again from the start of rs for each symlink followed.
+func ExtractFileFromTarFollow(rs io.ReadSeeker, file string) ([]byte, error) {
+	name := filepath.Clean(file)
+	for hops := 0; ; hops++ {
+		if _, err := rs.Seek(0, 0); err != nil {
+			return nil, fmt.Errorf("error seeking tarball: %w", err)
+		}
+		tr := tar.NewReader(rs)
+		hdr, err := nextEntry(tr, name)
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			buf, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting tarball: %w", err)
+			}
+			return buf, nil
+		case tar.TypeSymlink:
+			if hops == maxSymlinkHops {
+				return nil, fmt.Errorf("too many levels of symlinks resolving %q", file)
+			}
+			// Absolute targets are relative to the root of the tarball
+			target := filepath.Join(filepath.Dir(name), hdr.Linkname)
+			if filepath.IsAbs(hdr.Linkname) {
+				target = hdr.Linkname
+			}
+			if escapesRoot(target) {
+				return nil, &EntryError{Path: hdr.Name, Err: fmt.Errorf("%w %q -> %q", ErrInsecureLink, hdr.Name, hdr.Linkname)}
+			}
+			name = filepath.Clean("./" + target)
+		default:
+			return nil, fmt.Errorf("requested file not a regular file")
+		}
+	}
+}
+
+// OpenFileFromTar advances tr to the given regular file, returning a reader of
+// its contents along with its header. The reader reads directly from the
+// tarball, so it is only valid until the next call to tr.Next.
+func OpenFileFromTar(tr *tar.Reader, file string) (io.Reader, *tar.Header, error) {
+	hdr, err := nextEntry(tr, filepath.Clean(file))
+	if err != nil {
+		return nil, nil, err
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+	case tar.TypeRegA:
+	default:
+		return nil, nil, fmt.Errorf("requested file not a regular file")
+	}
+	return io.LimitReader(tr, hdr.Size), hdr, nil
+}
+
+// ExtractFileToWriter is like ExtractFileFromTar, but streams the contents of
+// the file to w instead of returning them
+func ExtractFileToWriter(tr *tar.Reader, file string, w io.Writer) error {
+	r, _, err := OpenFileFromTar(tr, file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("error extracting tarball: %w", err)
+	}
+	return nil
+}
+
+// ExtractFilesFromTar extracts the given regular files from the given tar in a
+// single pass, returning their contents keyed by the requested paths. It stops
+// reading the tarball as soon as all files are found.
+func ExtractFilesFromTar(tr *tar.Reader, files []string) (map[string][]byte, error) {
+	// requested paths, by cleaned path
+	wanted := make(map[string][]string)
+	for _, f := range files {
+		name := filepath.Clean(f)
+		wanted[name] = append(wanted[name], f)
+	}
+	bufs := make(map[string][]byte)
+	for len(wanted) > 0 {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error extracting tarball: %w", err)
+		}
+		name := filepath.Clean(hdr.Name)
+		paths, ok := wanted[name]
+		if !ok {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+		case tar.TypeRegA:
+		default:
+			return nil, fmt.Errorf("requested file %q not a regular file", hdr.Name)
+		}
+		buf, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("error extracting tarball: %w", err)
+		}
+		for _, p := range paths {
+			bufs[p] = buf
+		}
+		delete(wanted, name)
+	}
+	if len(wanted) > 0 {
+		var missing []string
+		for _, f := range files {
+			if _, ok := wanted[filepath.Clean(f)]; ok {
+				missing = append(missing, f)
+			}
+		}
+		return nil, fmt.Errorf("files not found: %s", strings.Join(missing, ", "))
+	}
+	return bufs, nil
+}
+
+// nextEntry advances tr to the entry with the cleaned path name, returning
+// its header
+func nextEntry(tr *tar.Reader, name string) (*tar.Header, error) {
+	for {
+		hdr, err := tr.Next()
+		switch err {
+		case io.EOF:
+			return nil, fmt.Errorf("file not found")
+		case nil:
+			if filepath.Clean(hdr.Name) == name {
+				return hdr, nil
+			}
+		default:
+			return nil, fmt.Errorf("error extracting tarball: %w", err)
+		}
+	}
+}
+
+// ExtractFileFromTarFold is like ExtractFileFromTar, but matches file with the
+// entries regardless of case, as on case-insensitive filesystems. The whole
+// tarball is read, and more than one entry matching is an error rather than
+// the first one being returned, as which one is meant is ambiguous.
+func ExtractFileFromTarFold(tr *tar.Reader, file string) ([]byte, error) {
+	name := filepath.Clean(file)
+	var (
+		found *tar.Header
+		buf   []byte
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error extracting tarball: %w", err)
+		}
+		if !strings.EqualFold(filepath.Clean(hdr.Name), name) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("ambiguous file %q: matched by %q and %q", file, found.Name, hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+		case tar.TypeRegA:
+		default:
+			return nil, fmt.Errorf("requested file not a regular file")
+		}
+		if buf, err = ioutil.ReadAll(tr); err != nil {
+			return nil, fmt.Errorf("error extracting tarball: %w", err)
+		}
+		found = hdr
+	}
+	if found == nil {
+		return nil, fmt.Errorf("file not found")
+	}
+	return buf, nil
+}
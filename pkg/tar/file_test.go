@@ -0,0 +1,369 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExtractFileFromTarFollow(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink.txt",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "abs.txt",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "/folder/symlink.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "loop1",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "loop2",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "loop2",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "loop1",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/escape.txt",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "../../etc/passwd",
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		file     string
+		contents string
+		err      bool
+	}{
+		{"folder/foo.txt", "foo", false},
+		{"folder/symlink.txt", "foo", false},
+		{"abs.txt", "foo", false},
+		{"loop1", "", true},
+		{"folder/escape.txt", "", true},
+		{"missing", "", true},
+	}
+	for _, tt := range tests {
+		buf, err := ExtractFileFromTarFollow(bytes.NewReader(b), tt.file)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.file)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.file, err)
+		}
+		if string(buf) != tt.contents {
+			t.Errorf("%s: unexpected contents, wanted: %s, got: %s", tt.file, tt.contents, buf)
+		}
+	}
+}
+
+func TestExtractFilesFromTar(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "baz",
+			header: &tar.Header{
+				Name: "baz.txt",
+				Size: 3,
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bufs, err := ExtractFilesFromTar(tar.NewReader(bytes.NewReader(b)), []string{"folder/foo.txt", "./baz.txt"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(bufs) != 2 || string(bufs["folder/foo.txt"]) != "foo" || string(bufs["./baz.txt"]) != "baz" {
+		t.Errorf("unexpected contents: %q", bufs)
+	}
+
+	_, err = ExtractFilesFromTar(tar.NewReader(bytes.NewReader(b)), []string{"missing1", "folder/bar.txt", "missing2"})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	for _, missing := range []string{"missing1", "missing2"} {
+		if !strings.Contains(err.Error(), missing) {
+			t.Errorf("expected error %q to mention %s", err, missing)
+		}
+	}
+}
+
+func TestOpenFileFromTar(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink.txt",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r, hdr, err := OpenFileFromTar(tar.NewReader(bytes.NewReader(b)), "folder/foo.txt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hdr.Name != "folder/foo.txt" {
+		t.Errorf("unexpected header name: %s", hdr.Name)
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if string(buf) != "foo" {
+		t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+	}
+
+	if _, _, err := OpenFileFromTar(tar.NewReader(bytes.NewReader(b)), "folder/symlink.txt"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestExtractFileFromTarFold(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "manifest",
+			header: &tar.Header{
+				Name: "Manifest",
+				Size: 8,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/Foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "MANIFEST",
+			header: &tar.Header{
+				Name: "./manifest",
+				Size: 8,
+			},
+		},
+	}
+	buf, err := ExtractFileFromTarFold(newTestTarReader(t, entries), "FOLDER/foo.TXT")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != "foo" {
+		t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+	}
+	if _, err := ExtractFileFromTarFold(newTestTarReader(t, entries), "manifest"); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("expected an ambiguous match error, got: %v", err)
+	}
+	if _, err := ExtractFileFromTarFold(newTestTarReader(t, entries), "missing"); err == nil {
+		t.Errorf("expected error for missing file")
+	}
+	// The exact match is unchanged
+	buf, err = ExtractFileFromTar(newTestTarReader(t, entries), "manifest")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != "MANIFEST" {
+		t.Errorf("unexpected contents, wanted: %s, got: %s", "MANIFEST", buf)
+	}
+}
+
+// seekCounter counts the calls to Seek of its io.ReadSeeker
+type seekCounter struct {
+	io.ReadSeeker
+	seeks int
+}
+
+func (sc *seekCounter) Seek(offset int64, whence int) (int64, error) {
+	sc.seeks++
+	return sc.ReadSeeker.Seek(offset, whence)
+}
+
+// readerOnly hides the Seek method of its reader
+type readerOnly struct {
+	io.Reader
+}
+
+func newLargeFilesTar(n, size int) ([]*testTarEntry, string) {
+	var entries []*testTarEntry
+	for i := 0; i < n; i++ {
+		entries = append(entries, &testTarEntry{
+			contents: strings.Repeat(string(rune('a'+i%26)), size),
+			header: &tar.Header{
+				Name: fmt.Sprintf("file%d", i),
+				Size: int64(size),
+			},
+		})
+	}
+	return entries, fmt.Sprintf("file%d", n-1)
+}
+
+func TestExtractFileFromTarSeek(t *testing.T) {
+	entries, last := newLargeFilesTar(8, 64*1024)
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := entries[len(entries)-1].contents
+
+	sc := &seekCounter{ReadSeeker: bytes.NewReader(b)}
+	buf, err := ExtractFileFromTar(tar.NewReader(sc), last)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != want {
+		t.Errorf("unexpected contents for %s", last)
+	}
+	if sc.seeks == 0 {
+		t.Errorf("expected the entries to be skipped by seeking")
+	}
+
+	buf, err = ExtractFileFromTar(tar.NewReader(readerOnly{bytes.NewReader(b)}), last)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != want {
+		t.Errorf("unexpected contents for %s", last)
+	}
+}
+
+func BenchmarkExtractFileFromTar(b *testing.B) {
+	entries, last := newLargeFilesTar(64, 1024*1024)
+	p, err := newTestTar(entries)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(p)
+	for _, seekable := range []bool{true, false} {
+		b.Run(fmt.Sprintf("seekable=%t", seekable), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				f, err := os.Open(p)
+				if err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+				var r io.Reader = f
+				if !seekable {
+					r = readerOnly{f}
+				}
+				if _, err := ExtractFileFromTar(tar.NewReader(r), last); err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+				f.Close()
+			}
+		})
+	}
+}
+
+func TestExtractFileToWriter(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link",
+				Linkname: "foo.txt",
+				Typeflag: tar.TypeSymlink,
+			},
+		},
+	}
+	var buf bytes.Buffer
+	if err := ExtractFileToWriter(newTestTarReader(t, entries), "./folder/foo.txt", &buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if buf.String() != "foo" {
+		t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf.String())
+	}
+	for _, file := range []string{"folder", "folder/link", "missing"} {
+		buf.Reset()
+		if err := ExtractFileToWriter(newTestTarReader(t, entries), file, &buf); err == nil {
+			t.Errorf("%s: expected error", file)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s: unexpected contents %q", file, buf.String())
+		}
+	}
+}
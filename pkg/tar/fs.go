@@ -0,0 +1,355 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Filesystem is where ExtractTarFS writes the extracted entries. Names are
+// the paths of the entries joined to the destination directory. Lstat and
+// Remove are needed to honour the overwrite policy and to create the missing
+// parent directories.
+type Filesystem interface {
+	Mkdir(name string, perm os.FileMode) error
+	// Create creates or truncates the regular file name
+	Create(name string, perm os.FileMode) (io.WriteCloser, error)
+	Symlink(oldname, newname string) error
+	Link(oldname, newname string) error
+	Chmod(name string, mode os.FileMode) error
+	// Chown changes the owner of name, not following symlinks. An id of
+	// -1 is left unchanged.
+	Chown(name string, uid, gid int) error
+	// Chtimes changes the times of name, not following symlinks
+	Chtimes(name string, atime, mtime time.Time) error
+	Lstat(name string) (os.FileInfo, error)
+	Remove(name string) error
+}
+
+// OSFilesystem is the Filesystem of the operating system
+type OSFilesystem struct{}
+
+func (OSFilesystem) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (OSFilesystem) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+}
+
+func (OSFilesystem) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (OSFilesystem) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+// Chmod follows a symlink at name, as chmod cannot do otherwise, so it fails
+// on them instead
+func (OSFilesystem) Chmod(name string, mode os.FileMode) error {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return &os.PathError{Op: "chmod", Path: name, Err: syscall.ELOOP}
+	}
+	return os.Chmod(name, mode)
+}
+
+func (OSFilesystem) Chown(name string, uid, gid int) error {
+	return os.Lchown(name, uid, gid)
+}
+
+// Chtimes does not follow a symlink at name
+func (OSFilesystem) Chtimes(name string, atime, mtime time.Time) error {
+	if err := lutimes(name, atime, mtime); err != nil {
+		return &os.PathError{Op: "utimensat", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (OSFilesystem) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (OSFilesystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// osFS is the Filesystem of the extractions not given one. Unlike
+// OSFilesystem, entries may be extracted through the symlinks it has that
+// resolve within the destination directory, and it also creates device nodes
+// and fifos and removes directories that are not empty.
+type osFS struct {
+	OSFilesystem
+}
+
+// errNotRoot is returned by osFS.Chown when not running as root, which
+// extraction reports as a warning
+var errNotRoot = errors.New("not running as root")
+
+// nodeFS is implemented by the Filesystems creating device nodes and fifos
+type nodeFS interface {
+	Mknod(name string, mode uint32, dev int) error
+	Mkfifo(name string, mode uint32) error
+}
+
+func (osFS) Mknod(name string, mode uint32, dev int) error {
+	if err := syscall.Mknod(name, mode, dev); err != nil {
+		return &os.PathError{Op: "mknod", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (osFS) Mkfifo(name string, mode uint32) error {
+	if err := syscall.Mkfifo(name, mode); err != nil {
+		return &os.PathError{Op: "mkfifo", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (fs osFS) Chown(name string, uid, gid int) error {
+	if os.Geteuid() != 0 {
+		return errNotRoot
+	}
+	return fs.OSFilesystem.Chown(name, uid, gid)
+}
+
+// Stat is like Lstat, but follows symlinks
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+// DiscardFS is a Filesystem discarding everything written to it, for
+// measuring the cost of an extraction other than the disk I/O. It counts the
+// calls of each of its methods. Nothing exists in it, so hardlinks can only
+// be extracted without DeferredHardlinks.
+type DiscardFS struct {
+	MkdirCalls, CreateCalls, SymlinkCalls, LinkCalls int
+	ChmodCalls, ChownCalls, ChtimesCalls, LstatCalls int
+	RemoveCalls                                      int
+	// BytesWritten is the size of the content written to the files created
+	BytesWritten int64
+}
+
+func (fs *DiscardFS) Mkdir(name string, perm os.FileMode) error {
+	fs.MkdirCalls++
+	return nil
+}
+
+func (fs *DiscardFS) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	fs.CreateCalls++
+	return discardFile{fs}, nil
+}
+
+func (fs *DiscardFS) Symlink(oldname, newname string) error {
+	fs.SymlinkCalls++
+	return nil
+}
+
+func (fs *DiscardFS) Link(oldname, newname string) error {
+	fs.LinkCalls++
+	return nil
+}
+
+func (fs *DiscardFS) Chmod(name string, mode os.FileMode) error {
+	fs.ChmodCalls++
+	return nil
+}
+
+func (fs *DiscardFS) Chown(name string, uid, gid int) error {
+	fs.ChownCalls++
+	return nil
+}
+
+func (fs *DiscardFS) Chtimes(name string, atime, mtime time.Time) error {
+	fs.ChtimesCalls++
+	return nil
+}
+
+func (fs *DiscardFS) Lstat(name string) (os.FileInfo, error) {
+	fs.LstatCalls++
+	return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *DiscardFS) Remove(name string) error {
+	fs.RemoveCalls++
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+}
+
+// discardFile is a file of a DiscardFS
+type discardFile struct {
+	fs *DiscardFS
+}
+
+func (f discardFile) Write(p []byte) (int, error) {
+	f.fs.BytesWritten += int64(len(p))
+	return len(p), nil
+}
+
+func (f discardFile) Close() error {
+	return nil
+}
+
+// ExtractTarFS extracts a tarball from the given tar.Reader into the directory
+// dir of fs, as configured by opts.
+// The Filesystem cannot resolve symlinks, so entries are never extracted
+// through one, even if it points inside dir; device nodes and fifos are not
+// supported, nor are the options acting on the operating system directly:
+// RestoreXattrs, SparseAware, Sync, Parallelism, FlattenHardlinks and
+// ApplyWhiteouts.
+func ExtractTarFS(fs Filesystem, tr *tar.Reader, dir string, opts ExtractTarOptions) error {
+	if err := checkFSOptions(opts); err != nil {
+		return fmt.Errorf("error extracting tarball: %w", err)
+	}
+	x := &extraction{
+		ctx:  context.Background(),
+		fs:   fs,
+		dir:  dir,
+		opts: opts,
+	}
+	return x.run(tr)
+}
+
+// checkFSOptions returns an error if opts cannot be honoured by ExtractTarFS
+func checkFSOptions(opts ExtractTarOptions) error {
+	switch {
+	case opts.RestoreXattrs:
+		return errors.New("RestoreXattrs is not supported with a Filesystem")
+	case opts.SparseAware:
+		return errors.New("SparseAware is not supported with a Filesystem")
+	case opts.Sync != SyncNone:
+		return errors.New("Sync is not supported with a Filesystem")
+	case opts.Parallelism > 1:
+		return errors.New("Parallelism is not supported with a Filesystem")
+	case opts.FlattenHardlinks:
+		return errors.New("FlattenHardlinks is not supported with a Filesystem")
+	case opts.ApplyWhiteouts:
+		return errors.New("ApplyWhiteouts is not supported with a Filesystem")
+	case opts.CleanupOnError:
+		return errors.New("CleanupOnError is not supported with a Filesystem")
+	case opts.AtomicFiles:
+		return errors.New("AtomicFiles is not supported with a Filesystem")
+	}
+	return nil
+}
+
+// finishDir applies perm, and the times if RestoreTimes or ClampMTime is set,
+// to the directory p, in dir of fs, described by hdr. Extracting into a
+// directory changes its modification time, so directory times are only
+// restored once all is extracted. Whatever is no longer a directory at p is
+// left alone.
+func finishDir(fs Filesystem, dir, p string, hdr *tar.Header, perm os.FileMode, opts ExtractTarOptions) error {
+	if err := checkParentsIn(fs, dir, p); err != nil {
+		return err
+	}
+	fi, err := fs.Lstat(p)
+	if os.IsNotExist(err) || err == nil && !fi.IsDir() {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := fs.Chmod(p, perm); err != nil {
+		return err
+	}
+	return restoreTimes(fs, p, hdr, opts)
+}
+
+// mkdirAllFS creates p, and its missing parents, with perm. The directories
+// between dir and p must not be symlinks, except for the OS filesystem, which
+// follows the ones checkParentsIn accepts. Like os.MkdirAll, it succeeds when
+// a directory is created at p concurrently.
+func mkdirAllFS(fs Filesystem, dir, p string, perm os.FileMode) error {
+	lstat := fs.Lstat
+	if ofs, ok := fs.(osFS); ok {
+		lstat = ofs.Stat
+	}
+	fi, err := lstat(p)
+	switch {
+	case err == nil && !below(dir, p):
+		// The destination directory and its parents may be symlinks
+		return nil
+	case err == nil && fi.IsDir():
+		return nil
+	case err == nil && fi.Mode()&os.ModeSymlink != 0:
+		return fmt.Errorf("%w in path %q: it is a symlink", ErrInsecureLink, p)
+	case err == nil:
+		return fmt.Errorf("%w: %q is a %s, not a directory", ErrPathConflict, p, fileTypeName(fi.Mode()))
+	case !os.IsNotExist(err):
+		return err
+	}
+	if parent := filepath.Dir(p); parent != p {
+		if err := mkdirAllFS(fs, dir, parent, perm); err != nil {
+			return err
+		}
+	}
+	err = fs.Mkdir(p, perm)
+	if err != nil && os.IsExist(err) {
+		if fi, lerr := fs.Lstat(p); lerr == nil && fi.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+// below returns whether p is a path below dir
+func below(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != "." && !escapesRoot(rel)
+}
+
+// checkParentsIn returns an error wrapping ErrInsecureLink if p, in dir of
+// fs, would be written through a symlink: one resolving outside of dir for the
+// OS filesystem, see checkParents, and any for the others, see
+// checkParentsFS.
+func checkParentsIn(fs Filesystem, dir, p string) error {
+	if _, ok := fs.(osFS); !ok {
+		return checkParentsFS(fs, dir, p)
+	}
+	err := checkParents(dir, p)
+	if errors.Is(err, syscall.ENOTDIR) {
+		if cerr := parentConflict(dir, p); cerr != nil {
+			return cerr
+		}
+	}
+	return err
+}
+
+// checkParentsFS returns an error wrapping ErrInsecureLink if a directory
+// between dir and p exists and is a symlink
+func checkParentsFS(fs Filesystem, dir, p string) error {
+	for parent := filepath.Dir(p); below(dir, parent); parent = filepath.Dir(parent) {
+		fi, err := fs.Lstat(parent)
+		if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%w in path %q: %q is a symlink", ErrInsecureLink, p, parent)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,448 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// memFS is an in-memory Filesystem
+type memFS map[string]*memFile
+
+type memFile struct {
+	name     string
+	mode     os.FileMode
+	data     bytes.Buffer
+	link     string
+	uid, gid int
+	mtime    time.Time
+}
+
+func (f *memFile) Name() string       { return filepath.Base(f.name) }
+func (f *memFile) Size() int64        { return int64(f.data.Len()) }
+func (f *memFile) Mode() os.FileMode  { return f.mode }
+func (f *memFile) ModTime() time.Time { return f.mtime }
+func (f *memFile) IsDir() bool        { return f.mode.IsDir() }
+func (f *memFile) Sys() interface{}   { return nil }
+func (f *memFile) Write(b []byte) (int, error) {
+	return f.data.Write(b)
+}
+func (f *memFile) Close() error { return nil }
+
+func (fs memFS) add(name string, mode os.FileMode) (*memFile, error) {
+	if _, ok := fs[name]; ok {
+		return nil, os.ErrExist
+	}
+	if parent, ok := fs[filepath.Dir(name)]; !ok || !parent.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	f := &memFile{name: name, mode: mode}
+	fs[name] = f
+	return f, nil
+}
+
+func (fs memFS) Mkdir(name string, perm os.FileMode) error {
+	_, err := fs.add(name, os.ModeDir|perm)
+	return err
+}
+
+func (fs memFS) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	if f, ok := fs[name]; ok {
+		f.data.Reset()
+		return f, nil
+	}
+	return fs.add(name, perm)
+}
+
+func (fs memFS) Symlink(oldname, newname string) error {
+	f, err := fs.add(newname, os.ModeSymlink|0777)
+	if err == nil {
+		f.link = oldname
+	}
+	return err
+}
+
+func (fs memFS) Link(oldname, newname string) error {
+	f, ok := fs[oldname]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if _, err := fs.add(newname, 0); err != nil {
+		return err
+	}
+	fs[newname] = f
+	return nil
+}
+
+func (fs memFS) get(name string) (*memFile, error) {
+	f, ok := fs[name]
+	if !ok {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+	}
+	return f, nil
+}
+
+func (fs memFS) Chmod(name string, mode os.FileMode) error {
+	f, err := fs.get(name)
+	if err == nil {
+		f.mode = f.mode&os.ModeType | mode
+	}
+	return err
+}
+
+func (fs memFS) Chown(name string, uid, gid int) error {
+	f, err := fs.get(name)
+	if err == nil {
+		f.uid, f.gid = uid, gid
+	}
+	return err
+}
+
+func (fs memFS) Chtimes(name string, atime, mtime time.Time) error {
+	f, err := fs.get(name)
+	if err == nil {
+		f.mtime = mtime
+	}
+	return err
+}
+
+func (fs memFS) Lstat(name string) (os.FileInfo, error) {
+	f, err := fs.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fs memFS) Remove(name string) error {
+	if _, err := fs.get(name); err != nil {
+		return err
+	}
+	delete(fs, name)
+	return nil
+}
+
+func TestExtractTarFS(t *testing.T) {
+	mtime := time.Unix(1234567890, 0)
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:    "folder/foo.txt",
+				Size:    3,
+				Mode:    0640,
+				Uid:     1000,
+				Gid:     1000,
+				ModTime: mtime,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/bar.txt",
+				Linkname: "folder/foo.txt",
+				Typeflag: tar.TypeLink,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link",
+				Linkname: "foo.txt",
+				Typeflag: tar.TypeSymlink,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder",
+				Typeflag: tar.TypeDir,
+				Mode:     0750,
+				ModTime:  mtime,
+			},
+		},
+	}
+	fs := memFS{"/dest": {name: "/dest", mode: os.ModeDir | 0755}}
+	opts := ExtractTarOptions{PreserveOwnership: true, RestoreTimes: true}
+	if err := ExtractTarFS(fs, newTestTarReader(t, entries), "/dest", opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	foo := fs["/dest/folder/foo.txt"]
+	if foo == nil {
+		t.Fatalf("file not extracted")
+	}
+	if foo.data.String() != "foo" || foo.mode != 0640 || foo.uid != 1000 || !foo.mtime.Equal(mtime) {
+		t.Errorf("unexpected file: %q, mode %v, uid %d, mtime %v", foo.data.String(), foo.mode, foo.uid, foo.mtime)
+	}
+	if fs["/dest/folder/bar.txt"] != foo {
+		t.Errorf("hardlink not extracted")
+	}
+	if l := fs["/dest/folder/link"]; l == nil || l.link != "foo.txt" {
+		t.Errorf("symlink not extracted")
+	}
+	if d := fs["/dest/folder"]; d.mode != os.ModeDir|0750 || !d.mtime.Equal(mtime) {
+		t.Errorf("unexpected directory: mode %v, mtime %v", d.mode, d.mtime)
+	}
+
+	// Entries are not extracted through symlinks
+	entries = []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "link",
+				Linkname: "folder",
+				Typeflag: tar.TypeSymlink,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "link/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	fs = memFS{"/dest": {name: "/dest", mode: os.ModeDir | 0755}}
+	err := ExtractTarFS(fs, newTestTarReader(t, entries), "/dest", ExtractTarOptions{})
+	if !errors.Is(err, ErrInsecureLink) {
+		t.Errorf("expected ErrInsecureLink, got: %v", err)
+	}
+
+	if err := ExtractTarFS(fs, newTestTarReader(t, entries), "/dest", ExtractTarOptions{Sync: SyncFiles}); err == nil {
+		t.Errorf("expected error for unsupported option")
+	}
+}
+
+func TestExtractTarOSFilesystem(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTarFS(OSFilesystem{}, newTestTarReader(t, entries), tmpdir, ExtractTarOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "folder/foo.txt"))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if string(buf) != "foo" {
+		t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+	}
+
+	// Not even through a symlink higher up than the parent of the entry
+	victim := newTestDir(t)
+	defer os.RemoveAll(victim)
+	if err := os.Mkdir(filepath.Join(victim, "b"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries = []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "a",
+				Linkname: victim,
+				Typeflag: tar.TypeSymlink,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "a/b/x",
+				Size: 3,
+			},
+		},
+	}
+	err = ExtractTarFS(OSFilesystem{}, newTestTarReader(t, entries), tmpdir, ExtractTarOptions{})
+	if !errors.Is(err, ErrInsecureLink) {
+		t.Errorf("expected ErrInsecureLink, got: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(victim, "b/x")); !os.IsNotExist(err) {
+		t.Errorf("expected no file to be written through the symlink, got: %v", err)
+	}
+}
+
+func TestDiscardFS(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link",
+				Linkname: "foo.txt",
+				Typeflag: tar.TypeSymlink,
+			},
+		},
+	}
+	fs := &DiscardFS{}
+	if err := ExtractTarFS(fs, newTestTarReader(t, entries), "/dest", ExtractTarOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fs.CreateCalls != 1 || fs.SymlinkCalls != 1 || fs.BytesWritten != 3 {
+		t.Errorf("unexpected calls: %+v", *fs)
+	}
+}
+
+func BenchmarkExtractTarDiscardFS(b *testing.B) {
+	buf := newSmallFilesTar(b, 1000, 100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := ExtractTarFS(&DiscardFS{}, tar.NewReader(bytes.NewReader(buf)), "/dest", ExtractTarOptions{}); err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+// fullFS is a memFS whose files fail to be written as if the disk was full
+type fullFS struct {
+	memFS
+}
+
+type fullFile struct{}
+
+func (fullFile) Write([]byte) (int, error) { return 0, syscall.ENOSPC }
+func (fullFile) Close() error              { return nil }
+
+func (fs fullFS) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	if _, err := fs.memFS.Create(name, perm); err != nil {
+		return nil, err
+	}
+	return fullFile{}, nil
+}
+
+func TestExtractTarFSNoSpace(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	fs := fullFS{memFS{"/dest": {name: "/dest", mode: os.ModeDir | 0755}}}
+	err := ExtractTarFS(fs, newTestTarReader(t, entries), "/dest", ExtractTarOptions{})
+	if !errors.Is(err, ErrNoSpace) || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("expected ErrNoSpace wrapping ENOSPC, got: %v", err)
+	}
+	err = ExtractTarFS(fs, newTestTarReader(t, entries), "/dest", ExtractTarOptions{CleanupOnError: true})
+	if err == nil {
+		t.Errorf("expected CleanupOnError to be rejected")
+	}
+}
+
+// writesFS counts the writes to the files it creates
+type writesFS struct {
+	memFS
+	writes *int
+}
+
+type writesFile struct {
+	io.WriteCloser
+	writes *int
+}
+
+func (f writesFile) Write(b []byte) (int, error) {
+	*f.writes++
+	return f.WriteCloser.Write(b)
+}
+
+func (fs writesFS) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	f, err := fs.memFS.Create(name, perm)
+	if err != nil {
+		return nil, err
+	}
+	return writesFile{f, fs.writes}, nil
+}
+
+func TestExtractTarFSBufferedWrites(t *testing.T) {
+	contents := strings.Repeat("x", 100)
+	entries := []*testTarEntry{
+		{
+			contents: contents,
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: int64(len(contents)),
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, tt := range []struct {
+		size, writes int
+	}{
+		{0, 1},
+		{16, 7},
+	} {
+		var writes int
+		fs := writesFS{memFS{"/dest": {name: "/dest", mode: os.ModeDir | 0755}}, &writes}
+		// The content is read a byte at a time, as from a slow decompressor
+		tr := tar.NewReader(iotest.OneByteReader(bytes.NewReader(b)))
+		if err := ExtractTarFS(fs, tr, "/dest", ExtractTarOptions{WriteBufferSize: tt.size}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if writes != tt.writes {
+			t.Errorf("buffer of %d bytes: unexpected %d writes, wanted %d", tt.size, writes, tt.writes)
+		}
+		if got := fs.memFS["/dest/foo.txt"].data.String(); got != contents {
+			t.Errorf("unexpected contents %q", got)
+		}
+	}
+}
+
+func TestMkdirAllFSConcurrent(t *testing.T) {
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	for i := 0; i < 100; i++ {
+		p := filepath.Join(tmpdir, fmt.Sprintf("x%d/y/z", i))
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- mkdirAllFS(osFS{}, tmpdir, p, 0755)
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+}
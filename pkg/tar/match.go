@@ -0,0 +1,129 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// PathMatcher selects the paths of a tarball to extract. Match is called with
+// cleaned paths relative to the root of the tar file.
+type PathMatcher interface {
+	Match(name string) bool
+}
+
+// PathSet is a set of paths, relative to the root of the tar file and
+// cleaned, that does not need to be held in memory, as when it is backed by a
+// database or a bloom filter. PathWhitelistMap is a PathSet.
+type PathSet interface {
+	Contains(name string) bool
+}
+
+// SetWhitelist returns a PathMatcher, to use as ExtractTarOptions.Whitelist,
+// matching the paths s contains
+func SetWhitelist(s PathSet) PathMatcher {
+	return setMatcher{s}
+}
+
+type setMatcher struct {
+	s PathSet
+}
+
+func (sm setMatcher) Match(name string) bool {
+	return sm.s.Contains(name)
+}
+
+// GlobWhitelist is a list of glob patterns matching the paths that should be
+// whitelisted. The patterns use the syntax of filepath.Match, and a "**"
+// component additionally matches any number of path components, so "bin/**"
+// matches bin and everything below it.
+type GlobWhitelist []string
+
+// Match returns whether name is matched by any of the patterns. Malformed
+// patterns match nothing.
+func (gwl GlobWhitelist) Match(name string) bool {
+	for _, pattern := range gwl {
+		if matchGlob(splitPath(pattern), splitPath(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// subtreeMatcher matches the paths at or below prefix that m, if not nil,
+// also matches
+type subtreeMatcher struct {
+	prefix []string
+	m      PathMatcher
+}
+
+func (sm subtreeMatcher) Match(name string) bool {
+	components := splitPath(name)
+	if len(components) < len(sm.prefix) {
+		return false
+	}
+	for i, c := range sm.prefix {
+		if components[i] != c {
+			return false
+		}
+	}
+	return sm.m == nil || sm.m.Match(name)
+}
+
+// excluded returns whether name, or one of its parent directories, is matched
+// by any of the patterns
+func excluded(patterns []string, name string) bool {
+	components := splitPath(name)
+	for _, pattern := range patterns {
+		p := splitPath(pattern)
+		for i := 1; i <= len(components); i++ {
+			if matchGlob(p, components[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(filepath.Clean(p), "/")
+	if p == "." {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// matchGlob matches the path components in name against the ones in pattern
+func matchGlob(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlob(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := filepath.Match(pattern[0], name[0]); !ok || err != nil {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
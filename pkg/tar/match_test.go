@@ -0,0 +1,115 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGlobWhitelist(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"folder/*.txt", "folder/foo.txt", true},
+		{"folder/*.txt", "folder/foo.bin", false},
+		{"folder/*.txt", "folder/deep/foo.txt", false},
+		{"bin/**", "bin", true},
+		{"bin/**", "bin/rkt", true},
+		{"bin/**", "bin/deep/rkt", true},
+		{"bin/**", "sbin/rkt", false},
+		{"**/*.txt", "foo.txt", true},
+		{"**/*.txt", "deep/folder/foo.txt", true},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "a/x/y/c", false},
+		{"[", "[", false},
+	}
+	for _, tt := range tests {
+		if match := (GlobWhitelist{tt.pattern}).Match(tt.name); match != tt.match {
+			t.Errorf("%q matching %q: got %v, wanted %v", tt.pattern, tt.name, match, tt.match)
+		}
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"dev", "dev", true},
+		{"dev", "dev/null", true},
+		{"dev", "devices", false},
+		{"proc/*", "proc/1/status", true},
+		{"proc/*", "proc", false},
+		{"*.log", "var/foo.log", false},
+		{"**/*.log", "var/foo.log", true},
+		{"**/*.log", "var/foo.log/bar", true},
+	}
+	for _, tt := range tests {
+		if match := excluded([]string{tt.pattern}, tt.name); match != tt.match {
+			t.Errorf("%q excluding %q: got %v, wanted %v", tt.pattern, tt.name, match, tt.match)
+		}
+	}
+}
+
+// prefixSet contains the paths starting with a prefix, without listing them
+type prefixSet string
+
+func (ps prefixSet) Contains(name string) bool {
+	return strings.HasPrefix(name, string(ps))
+}
+
+func TestSetWhitelist(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{Whitelist: SetWhitelist(prefixSet("foo"))}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpdir, "foo.txt")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpdir, "bar.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected bar.txt not to be extracted, got: %v", err)
+	}
+
+	var s PathSet = PathWhitelistMap{"foo.txt": {}}
+	if !s.Contains("foo.txt") || s.Contains("bar.txt") {
+		t.Errorf("unexpected PathWhitelistMap contents")
+	}
+}
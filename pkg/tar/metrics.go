@@ -0,0 +1,31 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import "time"
+
+// Metrics receives measurements of extractions, for example to export them
+// to a monitoring system. An extraction does not call its methods
+// concurrently, but extractions sharing it may.
+type Metrics interface {
+	// IncFiles is called for every entry extracted
+	IncFiles()
+	// AddBytes is called with the number of bytes of content written for
+	// every entry extracted with some content
+	AddBytes(n int64)
+	// ObserveDuration is called at the end of every extraction, failed or
+	// not, with the time it took
+	ObserveDuration(d time.Duration)
+}
@@ -0,0 +1,64 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+)
+
+// ExtractMultiTar is like ExtractTarReader, but extracts all of the tarballs
+// concatenated in r, in order, as one. The entries of a tarball overlay the
+// ones of the previous tarballs as per opts.Overwrite, and the limits of
+// opts apply to all of the tarballs together.
+// Blocks of zeros are skipped after the end-of-archive marker of each
+// tarball, as archivers pad tarballs to their record size, which is 10240
+// bytes by default for GNU tar; the next tarball starts at the first block
+// that is not zeros. Trailing data shorter than a block is an error.
+func ExtractMultiTar(r io.Reader, dir string, opts ExtractTarOptions) error {
+	x := &extraction{
+		ctx:  context.Background(),
+		dir:  dir,
+		opts: opts,
+		more: func() (*tar.Reader, error) {
+			return nextTar(r)
+		},
+	}
+	return x.run(tar.NewReader(newContentSkipper(r)))
+}
+
+// nextTar skips the blocks of zeros at the start of r, and returns a reader
+// of the tarball following them, or nil if r ends first
+func nextTar(r io.Reader) (*tar.Reader, error) {
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		switch {
+		case err == io.EOF:
+			return nil, nil
+		case err == io.ErrUnexpectedEOF:
+			return nil, fmt.Errorf("%d bytes of trailing data after the end of the tarball", n)
+		case err != nil:
+			return nil, err
+		}
+		if !isZero(block) {
+			mr := io.MultiReader(bytes.NewReader(block), r)
+			return tar.NewReader(newContentSkipper(mr)), nil
+		}
+	}
+}
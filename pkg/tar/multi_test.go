@@ -0,0 +1,116 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractMultiTar(t *testing.T) {
+	first, err := newTestTarBytes([]*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 3,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := newTestTarBytes([]*testTarEntry{
+		{
+			contents: "baz",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Pad the first tarball to a record of 10240 bytes, as GNU tar does
+	padding := make([]byte, 10240-len(first)%10240)
+	var stream []byte
+	for _, b := range [][]byte{first, padding, second} {
+		stream = append(stream, b...)
+	}
+
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractMultiTar(bytes.NewReader(stream), tmpdir, ExtractTarOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, want := range map[string]string{"foo.txt": "baz", "bar.txt": "bar"} {
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "folder", name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf) != want {
+			t.Errorf("unexpected contents of %s, wanted: %s, got: %s", name, want, buf)
+		}
+	}
+
+	// The limits apply to all of the tarballs
+	opts := ExtractTarOptions{MaxEntries: 2}
+	if err := ExtractMultiTar(bytes.NewReader(stream), tmpdir, opts); err != ErrTooManyEntries {
+		t.Errorf("expected ErrTooManyEntries, got: %v", err)
+	}
+
+	// A tarball can replace the directory of the previous ones with a file
+	third, err := newTestTarBytes([]*testTarEntry{
+		{
+			contents: "folder",
+			header: &tar.Header{
+				Name: "folder",
+				Size: 6,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	overlay := append(append([]byte{}, first...), third...)
+	for _, parallelism := range []int{0, 4} {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		opts := ExtractTarOptions{Parallelism: parallelism}
+		if err := ExtractMultiTar(bytes.NewReader(overlay), tmpdir, opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "folder")); err != nil || string(buf) != "folder" {
+			t.Errorf("unexpected contents of folder %q, error: %v", buf, err)
+		}
+	}
+
+	stream = append(stream, "trailing"...)
+	if err := ExtractMultiTar(bytes.NewReader(stream), tmpdir, ExtractTarOptions{}); err == nil {
+		t.Errorf("expected error for trailing data")
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+)
+
+// ParallelMaxFileSize is the size of the largest regular file buffered in
+// memory to be written concurrently, see ExtractTarOptions.Parallelism
+const ParallelMaxFileSize = 1 << 20
+
+// workerPool writes regular files concurrently while the entries following
+// them are read. Only files that cannot affect each other are pending at the
+// same time, so that the result is the same as for a sequential extraction.
+type workerPool struct {
+	jobs chan func() error
+	// pending counts the files submitted and not written yet
+	pending sync.WaitGroup
+
+	// mu guards err
+	mu  sync.Mutex
+	err error
+
+	// files are the cleaned names of the files submitted since the last
+	// wait, and dirs the names of their parent directories, of which
+	// missing are the ones that did not exist yet
+	files   map[string]struct{}
+	dirs    map[string]struct{}
+	missing map[string]struct{}
+}
+
+func newWorkerPool(n int) *workerPool {
+	wp := &workerPool{
+		jobs:    make(chan func() error, n),
+		files:   make(map[string]struct{}),
+		dirs:    make(map[string]struct{}),
+		missing: make(map[string]struct{}),
+	}
+	for i := 0; i < n; i++ {
+		go wp.work()
+	}
+	return wp
+}
+
+func (wp *workerPool) work() {
+	for job := range wp.jobs {
+		if err := job(); err != nil {
+			wp.mu.Lock()
+			if wp.err == nil {
+				wp.err = err
+			}
+			wp.mu.Unlock()
+		}
+		wp.pending.Done()
+	}
+}
+
+// extract extracts the relocated entry hdr, of the original header orig, as
+// part of x. Small regular files are read in memory and written by the
+// workers; anything else is extracted once the pending files are written.
+func (wp *workerPool) extract(x *extraction, tr *tar.Reader, orig, hdr *tar.Header) error {
+	if err := wp.error(); err != nil {
+		return err
+	}
+	name := filepath.Clean(hdr.Name)
+	concurrent := isRegular(hdr.Typeflag) && hdr.Size <= ParallelMaxFileSize
+	if !concurrent || wp.conflicts(name) {
+		if err := wp.wait(); err != nil {
+			return err
+		}
+	}
+	if !concurrent {
+		return x.extractFile(x.entryReader(tr), orig, hdr)
+	}
+	buf, err := ioutil.ReadAll(x.entryReader(tr))
+	if err != nil {
+		return fmt.Errorf("error extracting tarball: %w", err)
+	}
+	wp.files[name] = struct{}{}
+	exists := false
+	for d := filepath.Dir(name); d != "."; d = filepath.Dir(d) {
+		wp.dirs[d] = struct{}{}
+		// The worker creates the parents missing
+		if exists = exists || x.exists(d); !exists {
+			wp.missing[d] = struct{}{}
+		}
+	}
+	wp.pending.Add(1)
+	wp.jobs <- func() error {
+		return x.extractFile(bytes.NewReader(buf), orig, hdr)
+	}
+	return nil
+}
+
+// conflicts returns whether writing name could affect, or be affected by,
+// the files pending, including by creating the same missing parents
+func (wp *workerPool) conflicts(name string) bool {
+	if _, ok := wp.files[name]; ok {
+		return true
+	}
+	if _, ok := wp.dirs[name]; ok {
+		return true
+	}
+	for d := filepath.Dir(name); d != "."; d = filepath.Dir(d) {
+		if _, ok := wp.files[d]; ok {
+			return true
+		}
+		if _, ok := wp.missing[d]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// wait waits for the pending files to be written, and returns the first
+// error of the workers
+func (wp *workerPool) wait() error {
+	wp.pending.Wait()
+	wp.files = make(map[string]struct{})
+	wp.dirs = make(map[string]struct{})
+	wp.missing = make(map[string]struct{})
+	return wp.error()
+}
+
+func (wp *workerPool) error() error {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return wp.err
+}
+
+// close waits for the pending files and stops the workers
+func (wp *workerPool) close() {
+	wp.pending.Wait()
+	close(wp.jobs)
+}
@@ -0,0 +1,66 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"sort"
+	"strings"
+)
+
+// PAXPolicy says what to do with the PAX records not understood by the
+// extraction
+type PAXPolicy int
+
+const (
+	// IgnoreUnknownPAX silently ignores them
+	IgnoreUnknownPAX PAXPolicy = iota
+	// RejectUnknownPAX fails the extraction on the first entry having any
+	RejectUnknownPAX
+)
+
+// knownPAXRecords are the PAX records defined by POSIX
+var knownPAXRecords = map[string]struct{}{
+	"atime":      {},
+	"charset":    {},
+	"comment":    {},
+	"ctime":      {},
+	"gid":        {},
+	"gname":      {},
+	"hdrcharset": {},
+	"linkpath":   {},
+	"mtime":      {},
+	"path":       {},
+	"size":       {},
+	"uid":        {},
+	"uname":      {},
+}
+
+// unknownPAXRecords returns the sorted keys of the PAX records of hdr that are
+// neither defined by POSIX nor extended attributes or GNU sparse maps
+func unknownPAXRecords(hdr *tar.Header) []string {
+	var keys []string
+	for k := range hdr.PAXRecords {
+		if _, ok := knownPAXRecords[k]; ok {
+			continue
+		}
+		if strings.HasPrefix(k, paxXattrPrefix) || strings.HasPrefix(k, paxGNUSparsePrefix) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
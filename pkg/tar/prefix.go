@@ -0,0 +1,141 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// extractTarStream extracts the uncompressed tarball read from r, as done by
+// ExtractTarReader and ExtractArchive
+func extractTarStream(r io.Reader, dir string, opts ExtractTarOptions) error {
+	if opts.StripCommonPrefix {
+		n, rs, cleanup, err := scanCommonPrefix(r, opts)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		opts.StripComponents += n
+		opts.StripCommonPrefix = false
+		r = rs
+	}
+	return ExtractTarCounting(newCountingTarReader(r, true), dir, opts)
+}
+
+// scanCommonPrefix reads the headers of the tarball read from r, and returns
+// the number of leading directories its entries share, see commonPrefix, along
+// with a reader of the tarball from its start and a function releasing it.
+// The content of the entries is skipped by seeking if r can seek, and spooled
+// to a temporary file otherwise, within the limits of opts.
+func scanCommonPrefix(r io.Reader, opts ExtractTarOptions) (int, io.Reader, func(), error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		start, err := rs.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		n, err := commonPrefix(tar.NewReader(newContentSkipper(rs)), opts.StripComponents, nil)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if _, err := rs.Seek(start, io.SeekStart); err != nil {
+			return 0, nil, nil, err
+		}
+		return n, rs, func() {}, nil
+	}
+	f, err := ioutil.TempFile("", "rocket-tar-spool")
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	// The limits are checked on each header, before its content is
+	// spooled by reading the next one
+	var entries int
+	var total int64
+	check := func(hdr *tar.Header) error {
+		entries++
+		if opts.MaxEntries > 0 && entries > opts.MaxEntries {
+			return ErrTooManyEntries
+		}
+		if isRegular(hdr.Typeflag) && opts.MaxFileSize > 0 && hdr.Size > opts.MaxFileSize {
+			err := fileTooLarge(hdr.Name, opts.MaxFileSize)
+			return fmt.Errorf("error extracting tarball: %w", &EntryError{Path: hdr.Name, Err: err})
+		}
+		total += hdr.Size
+		if opts.MaxTotalBytes > 0 && total > opts.MaxTotalBytes {
+			return ErrSizeLimitExceeded
+		}
+		return nil
+	}
+	n, err := commonPrefix(tar.NewReader(io.TeeReader(r, f)), opts.StripComponents, check)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return 0, nil, nil, err
+	}
+	return n, f, cleanup, nil
+}
+
+// commonPrefix returns the number of leading directories shared by all of
+// the entries read from tr, once their first strip components are removed.
+// A directory entry counts as a directory of its own, but not the one of
+// the root of the tarball, as archived by "tar -C dir .". check, if not nil,
+// is called with each header read and stops the reading when it fails.
+func commonPrefix(tr *tar.Reader, strip int, check func(*tar.Header) error) (int, error) {
+	var (
+		prefix []string
+		first  = true
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return len(prefix), nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if check != nil {
+			if err := check(hdr); err != nil {
+				return 0, err
+			}
+		}
+		name, ok := stripComponents(hdr.Name, strip)
+		if !ok || (hdr.Typeflag == tar.TypeDir && path.Clean(name) == ".") {
+			continue
+		}
+		dirs := splitPath(path.Dir(name))
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = splitPath(name)
+		}
+		if first {
+			prefix, first = dirs, false
+			continue
+		}
+		n := 0
+		for n < len(prefix) && n < len(dirs) && prefix[n] == dirs[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+}
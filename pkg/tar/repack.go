@@ -0,0 +1,238 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// RepackTar writes to w a tarball of the entries of orig, a tarball extracted
+// into dir with opts, updated with the changes made to dir since then. The
+// entries whose file is unchanged are written with their original header and
+// content. The regular files whose content changed are written with their new
+// content, size and modification time, and the symlinks pointing elsewhere
+// with their new target, keeping the rest of their original header. The
+// entries whose file was removed are left out, and the ones whose file
+// changed type are written as the file now is. The entries the extraction
+// skips are copied as is. Files added to dir are not archived.
+func RepackTar(orig *tar.Reader, dir string, w io.Writer, opts ExtractTarOptions) error {
+	dir, err := resolveDir(dir)
+	if err != nil {
+		return fmt.Errorf("error repacking tarball: %w", err)
+	}
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := orig.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error repacking tarball: %w", err)
+		}
+		if err := repackEntry(tw, orig, hdr, dir, opts); err != nil {
+			return fmt.Errorf("error repacking tarball: %w", &EntryError{Path: hdr.Name, Err: err})
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("error repacking tarball: %w", err)
+	}
+	return nil
+}
+
+// repackEntry writes to tw the entry described by hdr, of content r, as
+// described by RepackTar
+func repackEntry(tw *tar.Writer, r io.Reader, hdr *tar.Header, dir string, opts ExtractTarOptions) error {
+	h, ok := extractedHeader(hdr, opts)
+	if !ok {
+		return copyEntry(tw, hdr, r)
+	}
+	p := filepath.Join(dir, h.Name)
+	if err := checkInside(dir, p); err != nil {
+		return err
+	}
+	// Nor through a symlink changed since the extraction
+	if err := checkParents(dir, p); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	want, ok := entryFileType(h.Typeflag)
+	switch {
+	case h.Typeflag == tar.TypeLink || !ok:
+		// The file of a hardlink is the one of its target
+		return copyEntry(tw, hdr, r)
+	case fi.Mode().Type() != want:
+		return addFromDisk(tw, hdr.Name, p, fi)
+	case isRegular(h.Typeflag):
+		same := fi.Size() == hdr.Size
+		if same {
+			if same, err = sameContent(r, p); err != nil {
+				return err
+			}
+		}
+		out := hdr
+		if !same {
+			c := *hdr
+			c.Size = fi.Size()
+			c.ModTime = fi.ModTime()
+			// The original format may not fit the new values
+			c.Format = tar.FormatUnknown
+			out = &c
+		}
+		return writeFromDisk(tw, out, p)
+	case h.Typeflag == tar.TypeSymlink:
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		extracted := h.Linkname
+		if opts.RebaseAbsoluteLinks && filepath.IsAbs(extracted) {
+			extracted = rebaseLink(h.Name, extracted)
+		}
+		if target == extracted {
+			return copyEntry(tw, hdr, r)
+		}
+		c := *hdr
+		c.Linkname = target
+		c.Format = tar.FormatUnknown
+		return tw.WriteHeader(&c)
+	}
+	return copyEntry(tw, hdr, r)
+}
+
+// extractedHeader returns the header of the entry described by hdr as it is
+// extracted with opts, or false if it is not extracted
+func extractedHeader(hdr *tar.Header, opts ExtractTarOptions) (*tar.Header, bool) {
+	if opts.NormalizeSeparators {
+		hdr = normalizeSeparators(hdr)
+	}
+	if checkName(hdr) != nil {
+		return nil, false
+	}
+	if opts.Whitelist != nil && !opts.Whitelist.Match(filepath.Clean(hdr.Name)) {
+		return nil, false
+	}
+	hdr, ok, err := opts.relocate(hdr)
+	if err != nil || !ok {
+		return nil, false
+	}
+	if opts.ApplyWhiteouts && isWhiteout(hdr) {
+		return nil, false
+	}
+	if !opts.typeAllowed(hdr.Typeflag) || (opts.SkeletonOnly && hdr.Typeflag != tar.TypeDir) {
+		return nil, false
+	}
+	return hdr, true
+}
+
+// copyEntry writes the entry described by hdr, of content r, to tw unchanged
+func copyEntry(tw *tar.Writer, hdr *tar.Header, r io.Reader) error {
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+// sameContent returns whether r reads the same content as the file p, which
+// has the same size
+func sameContent(r io.Reader, p string) (bool, error) {
+	f, err := openNoFollow(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	a := make([]byte, DefaultWriteBufferSize)
+	b := make([]byte, DefaultWriteBufferSize)
+	for {
+		n, err := io.ReadFull(r, a)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return false, err
+		}
+		if n > 0 {
+			if _, err := io.ReadFull(f, b[:n]); err != nil {
+				// The file got shorter
+				return false, nil
+			}
+			if !bytes.Equal(a[:n], b[:n]) {
+				return false, nil
+			}
+		}
+		if err != nil {
+			return true, nil
+		}
+	}
+}
+
+// writeFromDisk writes hdr to tw, followed by the content of the regular file
+// p
+func writeFromDisk(tw *tar.Writer, hdr *tar.Header, p string) error {
+	// Sparse files are written in full
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		c := *hdr
+		c.Typeflag = tar.TypeReg
+		hdr = &c
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	f, err := openNoFollow(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(tw, f, hdr.Size)
+	return err
+}
+
+// openNoFollow opens the file p for reading, failing if it is a symlink
+func openNoFollow(p string) (*os.File, error) {
+	return os.OpenFile(p, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+}
+
+// addFromDisk writes to tw an entry named name describing the file p, of info
+// fi
+func addFromDisk(tw *tar.Writer, name, p string, fi os.FileInfo) error {
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	if fi.Mode().IsRegular() {
+		return writeFromDisk(tw, hdr, p)
+	}
+	return tw.WriteHeader(hdr)
+}
@@ -0,0 +1,237 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRepackTar(t *testing.T) {
+	mtime := time.Unix(1400000000, 0)
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+				ModTime:  mtime,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:    "folder/foo.txt",
+				Size:    3,
+				Mode:    int64(0640),
+				Uid:     1000,
+				ModTime: mtime,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name:    "folder/bar.txt",
+				Size:    3,
+				Mode:    int64(0644),
+				Uid:     1000,
+				ModTime: mtime,
+			},
+		},
+		{
+			contents: "baz",
+			header: &tar.Header{
+				Name:    "folder/removed.txt",
+				Size:    3,
+				Mode:    int64(0644),
+				ModTime: mtime,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link",
+				Linkname: "foo.txt",
+				Typeflag: tar.TypeSymlink,
+				ModTime:  mtime,
+			},
+		},
+		{
+			contents: "skipped",
+			header: &tar.Header{
+				Name:    "skipped.txt",
+				Size:    7,
+				Mode:    int64(0600),
+				ModTime: mtime,
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	opts := ExtractTarOptions{Exclude: []string{"skipped.txt"}}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTarWithOptions(tar.NewReader(bytes.NewReader(b)), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpdir, "folder/bar.txt"), []byte("changed"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Remove(filepath.Join(tmpdir, "folder/removed.txt")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Remove(filepath.Join(tmpdir, "folder/link")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Symlink("bar.txt", filepath.Join(tmpdir, "folder/link")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := RepackTar(tar.NewReader(bytes.NewReader(b)), tmpdir, &out, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	orig := make(map[string]*tar.Header)
+	for _, e := range entries {
+		orig[e.header.Name] = e.header
+	}
+	var names []string
+	tr := tar.NewReader(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		names = append(names, hdr.Name)
+		buf, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		o := orig[hdr.Name]
+		switch hdr.Name {
+		case "folder/bar.txt":
+			if string(buf) != "changed" || hdr.Size != 7 {
+				t.Errorf("%s: unexpected content %q of size %d", hdr.Name, buf, hdr.Size)
+			}
+			if hdr.Uid != o.Uid || hdr.Mode != o.Mode {
+				t.Errorf("%s: expected the original uid and mode, got %d and %o", hdr.Name, hdr.Uid, hdr.Mode)
+			}
+		case "folder/link":
+			if hdr.Linkname != "bar.txt" {
+				t.Errorf("%s: unexpected target %q", hdr.Name, hdr.Linkname)
+			}
+		default:
+			if !hdr.ModTime.Equal(o.ModTime) || hdr.Mode != o.Mode || hdr.Uid != o.Uid || hdr.Size != o.Size {
+				t.Errorf("%s: expected the original header, got %+v", hdr.Name, hdr)
+			}
+		}
+		if hdr.Name == "folder/foo.txt" && string(buf) != "foo" {
+			t.Errorf("%s: unexpected content %q", hdr.Name, buf)
+		}
+		if hdr.Name == "skipped.txt" && string(buf) != "skipped" {
+			t.Errorf("%s: unexpected content %q", hdr.Name, buf)
+		}
+	}
+	want := []string{"folder/", "folder/foo.txt", "folder/bar.txt", "folder/link", "skipped.txt"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("unexpected entries %v, wanted %v", names, want)
+	}
+}
+
+func TestRepackTarUnchanged(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:    "folder/foo.txt",
+				Size:    3,
+				Mode:    int64(0640),
+				ModTime: time.Unix(1400000000, 0),
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTarWithOptions(tar.NewReader(bytes.NewReader(b)), tmpdir, ExtractTarOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var out bytes.Buffer
+	if err := RepackTar(tar.NewReader(bytes.NewReader(b)), tmpdir, &out, ExtractTarOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), b) {
+		t.Errorf("expected the tarball to be repacked unchanged")
+	}
+}
+
+func TestRepackTarSymlinkedParent(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTarWithOptions(tar.NewReader(bytes.NewReader(b)), tmpdir, ExtractTarOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Replace folder with a symlink to a directory outside of tmpdir
+	outside := newTestDir(t)
+	defer os.RemoveAll(outside)
+	if err := ioutil.WriteFile(filepath.Join(outside, "foo.txt"), []byte("bar"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(tmpdir, "folder")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(tmpdir, "folder")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var out bytes.Buffer
+	err = RepackTar(tar.NewReader(bytes.NewReader(b)), tmpdir, &out, ExtractTarOptions{})
+	if !errors.Is(err, ErrInsecureLink) {
+		t.Errorf("expected ErrInsecureLink, got: %v", err)
+	}
+	if bytes.Contains(out.Bytes(), []byte("bar")) {
+		t.Errorf("unexpected content from outside of the directory")
+	}
+}
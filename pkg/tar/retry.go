@@ -0,0 +1,53 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"time"
+)
+
+// writeRetryBackoff is the delay before retrying a failed write, doubled on
+// each retry of the same write
+var writeRetryBackoff = 10 * time.Millisecond
+
+// retryWriter writes to w, retrying the writes failing with a transient
+// error up to retries times
+type retryWriter struct {
+	w       io.Writer
+	retries int
+}
+
+func (rw retryWriter) Write(p []byte) (int, error) {
+	var n int
+	backoff := writeRetryBackoff
+	for attempt := 0; ; attempt++ {
+		m, err := rw.w.Write(p[n:])
+		n += m
+		if err == nil || attempt >= rw.retries || !retriable(err) {
+			return n, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// retriable returns whether err is transient, so that the operation failing
+// with it may succeed if retried
+func retriable(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
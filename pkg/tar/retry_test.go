@@ -0,0 +1,70 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// failingWriter fails its writes with the errors in errs, after writing one
+// byte, until it runs out of them
+type failingWriter struct {
+	buf  bytes.Buffer
+	errs []error
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if len(fw.errs) == 0 {
+		return fw.buf.Write(p)
+	}
+	err := fw.errs[0]
+	fw.errs = fw.errs[1:]
+	n, _ := fw.buf.Write(p[:1])
+	return n, err
+}
+
+func TestRetryWriter(t *testing.T) {
+	defer func(d time.Duration) { writeRetryBackoff = d }(writeRetryBackoff)
+	writeRetryBackoff = time.Millisecond
+
+	eagain := &os.PathError{Op: "write", Path: "foo", Err: syscall.EAGAIN}
+	tests := []struct {
+		errs    []error
+		retries int
+		want    string
+		err     error
+	}{
+		{nil, 0, "foobar", nil},
+		{[]error{eagain, syscall.EINTR}, 2, "foobar", nil},
+		{[]error{eagain, eagain, eagain}, 2, "foo", syscall.EAGAIN},
+		{[]error{syscall.ENOSPC}, 2, "f", syscall.ENOSPC},
+		{[]error{syscall.EINTR, syscall.EPERM}, 2, "fo", syscall.EPERM},
+	}
+	for i, tt := range tests {
+		fw := &failingWriter{errs: tt.errs}
+		n, err := retryWriter{fw, tt.retries}.Write([]byte("foobar"))
+		if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+			t.Errorf("#%d: unexpected error %v, wanted %v", i, err, tt.err)
+		}
+		if got := fw.buf.String(); got != tt.want || n != len(tt.want) {
+			t.Errorf("#%d: unexpected content %q (%d bytes), wanted %q", i, got, n, tt.want)
+		}
+	}
+}
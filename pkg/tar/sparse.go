@@ -0,0 +1,85 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"io"
+	"strings"
+)
+
+// sparseBlockSize is the size of the blocks checked for zeros, matching the
+// usual filesystem block size
+const sparseBlockSize = 4096
+
+// paxGNUSparsePrefix prefixes the PAX records of GNU sparse files
+const paxGNUSparsePrefix = "GNU.sparse."
+
+// isSparse returns whether hdr describes a GNU sparse file, in either the old
+// GNU or the PAX format
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, paxGNUSparsePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sparseFile is a file that can have holes, such as an *os.File
+type sparseFile interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+}
+
+// sparseWriter writes to f, seeking over the blocks of zeros instead of
+// writing them so that they become holes. The caller must truncate f to the
+// number of bytes written, for the trailing holes.
+type sparseWriter struct {
+	f sparseFile
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		b := p
+		if len(b) > sparseBlockSize {
+			b = b[:sparseBlockSize]
+		}
+		if isZero(b) {
+			if _, err := w.f.Seek(int64(len(b)), io.SeekCurrent); err != nil {
+				return n, err
+			}
+		} else if m, err := w.f.Write(b); err != nil {
+			return n + m, err
+		}
+		n += len(b)
+		p = p[len(b):]
+	}
+	return n, nil
+}
+
+// isZero returns whether b only contains zeros
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// allocated returns the number of bytes allocated on disk for the file at p
+func allocated(t *testing.T, p string) int64 {
+	var st syscall.Stat_t
+	if err := syscall.Stat(p, &st); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return st.Blocks * 512
+}
+
+func TestExtractTarSparseAware(t *testing.T) {
+	const size = 1 << 20
+	contents := strings.Repeat("\x00", size-3) + "foo"
+	entries := []*testTarEntry{
+		{
+			contents: contents,
+			header: &tar.Header{
+				Name: "disk.img",
+				Size: size,
+			},
+		},
+		{
+			contents: strings.Repeat("\x00", size),
+			header: &tar.Header{
+				Name: "zeros.img",
+				Size: size,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{SparseAware: true}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, e := range entries {
+		p := filepath.Join(tmpdir, e.header.Name)
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf) != e.contents {
+			t.Errorf("%s: unexpected contents", e.header.Name)
+		}
+		if n := allocated(t, p); n >= size {
+			t.Skipf("%s: %d bytes allocated, the filesystem may not support holes", e.header.Name, n)
+		}
+	}
+}
+
+func TestExtractTarGNUSparse(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar not found in $PATH")
+	}
+	const size = 1 << 20
+	srcdir := newTestDir(t)
+	defer os.RemoveAll(srcdir)
+	f, err := os.Create(filepath.Join(srcdir, "disk.img"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("foo"), size/2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.Close()
+	if n := allocated(t, f.Name()); n >= size {
+		t.Skipf("%d bytes allocated, the filesystem may not support holes", n)
+	}
+
+	for _, format := range []string{"gnu", "posix"} {
+		cmd := exec.Command("tar", "--sparse", "--format="+format, "-C", srcdir, "-cf", "-", "disk.img")
+		b, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", format, err)
+		}
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		if err := ExtractTar(tar.NewReader(bytes.NewReader(b)), tmpdir, nil); err != nil {
+			t.Fatalf("%s: unexpected error: %v", format, err)
+		}
+		p := filepath.Join(tmpdir, "disk.img")
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", format, err)
+		}
+		want := make([]byte, size)
+		copy(want[size/2:], "foo")
+		if !bytes.Equal(buf, want) {
+			t.Errorf("%s: unexpected contents", format)
+		}
+		if n := allocated(t, p); n >= size {
+			t.Errorf("%s: %d bytes allocated, expected a sparse file", format, n)
+		}
+	}
+}
@@ -16,127 +16,2037 @@ package tar
 
 import (
 	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 const DEFAULT_DIR_MODE os.FileMode = 0755
 
+// DefaultWriteBufferSize is the default of ExtractTarOptions.WriteBufferSize
+const DefaultWriteBufferSize = 32 * 1024
+
+// DefaultMaxLinkLength is the default of ExtractTarOptions.MaxLinkLength,
+// the PATH_MAX of Linux
+const DefaultMaxLinkLength = 4096
+
+var (
+	ErrSizeLimitExceeded = errors.New("extracted size limit exceeded")
+	ErrTooManyEntries    = errors.New("tarball entry limit exceeded")
+	ErrTooManyLinks      = errors.New("tarball link limit exceeded")
+
+	// ErrInsecureLink is wrapped by the errors for links pointing outside
+	// of the destination directory, and for entries that would be written
+	// through such links
+	ErrInsecureLink = errors.New("insecure link")
+	// ErrPathEscape is wrapped by the errors for entries whose path is
+	// outside of the destination directory
+	ErrPathEscape = errors.New("insecure path")
+	// ErrUnsupportedType is wrapped by the errors for entries of a type
+	// that cannot be extracted
+	ErrUnsupportedType = errors.New("unsupported type")
+	// ErrFileTooLarge is wrapped by the errors for regular files larger
+	// than ExtractTarOptions.MaxFileSize
+	ErrFileTooLarge = errors.New("file size limit exceeded")
+	// ErrTypeNotAllowed is wrapped by the errors for entries of a type not
+	// in ExtractTarOptions.AllowedTypes, when StrictTypes is set
+	ErrTypeNotAllowed = errors.New("type not allowed")
+	// ErrInvalidName is wrapped by the errors for entries whose name is
+	// empty, absolute, or refers to the destination directory itself
+	// without being a directory
+	ErrInvalidName = errors.New("invalid entry name")
+	// ErrNoSpace is wrapped, along with the cause, by the errors for
+	// extractions that ran out of space on the destination filesystem
+	ErrNoSpace = errors.New("no space left to extract tarball")
+	// ErrTruncatedArchive is wrapped by the errors for tarballs ending
+	// without an end-of-archive marker, when
+	// ExtractTarOptions.RequireEndMarker is set
+	ErrTruncatedArchive = errors.New("truncated archive")
+	// ErrPathConflict is wrapped by the errors for entries below a path
+	// where something else than a directory exists, as when a tarball has
+	// both a "foo" file and a "foo/bar" entry
+	ErrPathConflict = errors.New("path conflict")
+)
+
+// EntryError records an error and the path, in the tarball, of the entry that
+// caused it. The errors returned for entries that fail to extract wrap an
+// EntryError, which wraps the cause.
+type EntryError struct {
+	Path string
+	Err  error
+}
+
+func (e *EntryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// EntryErrors lists the entries that failed to extract, when
+// ExtractTarOptions.ContinueOnError is set
+type EntryErrors []*EntryError
+
+func (e EntryErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = fmt.Sprintf("%q: %v", err.Path, err.Err)
+	}
+	return fmt.Sprintf("%d entries failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the EntryErrors, for errors.Is and errors.As
+func (e EntryErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// insecureLinkError predates ErrInsecureLink, which satisfies it like any
+// other error does
 type insecureLinkError error
 
+// errEntrySkipped is returned by extractFile for entries it did not extract
+var errEntrySkipped = errors.New("entry skipped")
+
 // Map of paths that should be whitelisted. The paths should be relative to the
 // root of the tar file and should be cleaned (for example using filepath.Clean)
 type PathWhitelistMap map[string]struct{}
 
+// Match returns whether name is in the map. A nil map matches every name.
+func (pwl PathWhitelistMap) Match(name string) bool {
+	if pwl == nil {
+		return true
+	}
+	_, ok := pwl[name]
+	return ok
+}
+
+// Contains returns whether name is in the map, like Match
+func (pwl PathWhitelistMap) Contains(name string) bool {
+	return pwl.Match(name)
+}
+
+// ExtractTarOptions controls the behavior of ExtractTarWithOptions. The zero
+// value extracts every entry the same way ExtractTar does.
+type ExtractTarOptions struct {
+	// Whitelist, if not nil, restricts extraction to the paths it matches.
+	// Entries of any type it does not match, including directories and
+	// symlinks, are skipped. The parent directories of matched entries are
+	// created with DEFAULT_DIR_MODE when they are not extracted themselves.
+	Whitelist PathMatcher
+	// Overwrite says what to do with files already existing at the path of
+	// an entry. It defaults to replacing them.
+	Overwrite OverwritePolicy
+	// PreserveOwnership sets the owner of each extracted file to the uid
+	// and gid recorded in its header. It is ignored when not running as
+	// root, in which case files are owned by the extracting user.
+	PreserveOwnership bool
+	// UIDMap and GIDMap, if not nil, translate the uid and gid of each
+	// header before PreserveOwnership applies them. Extraction fails on
+	// ids not covered by any of the mappings.
+	UIDMap []IDMapping
+	GIDMap []IDMapping
+	// RestoreXattrs sets the extended attributes recorded in the PAX
+	// records of each entry on the extracted file.
+	RestoreXattrs bool
+	// RestoreTimes sets the access and modification times of each
+	// extracted file to the ones recorded in its header. Directory times
+	// are set after the whole tarball is extracted.
+	RestoreTimes bool
+	// ClampMTime, if not nil, is given as access and modification time to
+	// every file, directory and symlink extracted, including the parent
+	// directories created implicitly, instead of the times in their
+	// headers or the current time, as with SOURCE_DATE_EPOCH. It
+	// overrides RestoreTimes.
+	ClampMTime *time.Time
+	// SkipDevices causes character and block device entries to be skipped,
+	// with a logged note, when not running as root instead of failing the
+	// extraction.
+	SkipDevices bool
+	// OnEntry, if not nil, is called after each entry is extracted with its
+	// header and the number of bytes of content written for it, which is
+	// zero for anything but regular files.
+	OnEntry func(hdr *tar.Header, bytesWritten int64)
+	// MaxTotalBytes, if positive, limits the total size of the content of
+	// the extracted regular files. Extraction stops with
+	// ErrSizeLimitExceeded before writing an entry that would exceed it.
+	MaxTotalBytes int64
+	// MaxFileSize, if positive, limits the size of each regular file
+	// extracted, whatever its header declares. Extraction stops with an
+	// error wrapping ErrFileTooLarge on the first file exceeding it, which
+	// is not left behind.
+	MaxFileSize int64
+	// MaxEntries, if positive, limits the number of entries read from the
+	// tarball. Extraction stops with ErrTooManyEntries once it is exceeded.
+	MaxEntries int
+	// MaxLinks, if positive, limits the combined number of symlinks and
+	// hardlinks extracted. Extraction stops with ErrTooManyLinks before
+	// extracting a link that would exceed it.
+	MaxLinks int
+	// StripComponents removes that many leading components from the path
+	// of each entry, and from the target of hardlinks, before extracting it.
+	// Entries with no more components than that are skipped.
+	StripComponents int
+	// StripCommonPrefix removes the leading directories shared by all of
+	// the entries, after StripComponents, and is a no-op if they share
+	// none. The tarball is read twice for that, so it is only supported
+	// by ExtractTarReader and ExtractArchive, which spool non-seekable
+	// streams to a temporary file. The spooling stops as soon as
+	// MaxEntries, MaxFileSize or MaxTotalBytes is exceeded, counting the
+	// content of every entry, including the ones not extracted.
+	StripCommonPrefix bool
+	// Rename, if not nil, is called with the cleaned path of each entry,
+	// after StripComponents is applied, and with the target of hardlinks.
+	// It returns the path to extract the entry to, which must be relative,
+	// or false to skip the entry. The path returned is still subject to
+	// the usual checks against escaping the destination directory.
+	Rename func(name string) (string, bool)
+	// ReplaceDir allows ExtractTarAtomic to replace an existing
+	// destination directory, instead of failing.
+	ReplaceDir bool
+	// DeferredHardlinks allows hardlinks to appear in the tarball before
+	// their target. Such hardlinks are created after all other entries,
+	// and the extraction fails if their target was still not extracted.
+	DeferredHardlinks bool
+	// DetectDuplicates fails the extraction when a path appears more than
+	// once in the tarball, whatever the types of the entries, so that
+	// a later entry cannot replace one that was already inspected.
+	DetectDuplicates bool
+	// SparseAware makes the blocks of zeros in regular files holes, where
+	// the filesystem supports them. Sparse entries always get their holes
+	// restored.
+	SparseAware bool
+	// FileHashes, if not nil, maps the cleaned paths of regular files, as
+	// extracted and relative to the destination, to the hex encoded sha256
+	// of their content. Extraction fails on the first file whose content
+	// does not match, and the file is removed.
+	FileHashes map[string]string
+	// StrictHashes makes extraction fail on regular files not listed in
+	// FileHashes, before they are written.
+	StrictHashes bool
+	// Exclude lists glob patterns, with the syntax of GlobWhitelist, of
+	// entries to skip. They are matched against the names after
+	// StripComponents and Rename, and an entry is also skipped when one of
+	// its parent directories matches. When Whitelist is also set, entries
+	// are only extracted if they are whitelisted and not excluded.
+	// Hardlinks to excluded entries fail to extract.
+	Exclude []string
+	// DestPrefix, if not empty, is a relative path prepended to the names
+	// of all entries, after StripComponents, Rename and Exclude apply. It
+	// is created when the first entry is extracted, and the security
+	// checks still apply to the destination directory. It must not contain
+	// ".." components.
+	DestPrefix string
+	// RebaseAbsoluteLinks rewrites absolute symlink targets into relative
+	// ones pointing to the same path within the destination directory, so
+	// that "usr/bin/python" -> "/usr/bin/python3" becomes a link to
+	// "python3". Otherwise they are created unchanged.
+	RebaseAbsoluteLinks bool
+	// WriteBufferSize is the size of the buffer used to write regular
+	// files. It defaults to DefaultWriteBufferSize. The buffers are pooled
+	// and reused by all of the extractions.
+	WriteBufferSize int
+	// Parallelism, if greater than one, is the number of regular files
+	// written concurrently. Their content is buffered in memory, up to
+	// ParallelMaxFileSize per file, while the next entries are read; larger
+	// files and other entries are extracted once the pending files are
+	// written. The manifest and OnEntry, which is never called
+	// concurrently, may then see regular files out of archive order.
+	Parallelism int
+	// Sync trades the speed of the extraction for durability, see
+	// SyncPolicy. It defaults to SyncNone.
+	Sync SyncPolicy
+	// OnWarn, if not nil, is called with the path and the cause of the
+	// problems that do not stop the extraction, such as skipped device
+	// nodes or ownership not preserved when not running as root. When nil,
+	// they are logged, except for the ownership not preserved.
+	OnWarn func(path string, err error)
+	// ApplyWhiteouts makes the entries named ".wh.<name>" remove <name>
+	// from the destination directory, and the ones named ".wh..wh..opq"
+	// remove what is in their directory, except for the entries extracted
+	// from the same tarball, as done when applying the layers of overlay
+	// file systems. The whiteouts themselves are not extracted.
+	ApplyWhiteouts bool
+	// FlattenHardlinks extracts hardlinks as copies of their target, for
+	// destinations not supporting hardlinks. The copies are made from the
+	// target already extracted, so each of them costs the time to copy and
+	// the disk space of the target, which count for MaxTotalBytes.
+	FlattenHardlinks bool
+	// AllowedTypes, if not nil, lists the type flags of the entries to
+	// extract, tar.TypeReg standing for all the types of regular files.
+	// Entries of other types are skipped, or fail the extraction if
+	// StrictTypes is set. When nil, all the supported types are extracted.
+	AllowedTypes []byte
+	StrictTypes  bool
+	// SkeletonOnly only extracts the directory entries, with their
+	// parents, and skips all other entries. The manifest then lists the
+	// directories created as not skipped.
+	SkeletonOnly bool
+	// ContinueOnError keeps extracting the next entries when one fails
+	// to extract, the errors being returned together as EntryErrors once
+	// all is extracted. Errors reading the tarball, and the ones of the
+	// limits and the options, still stop the extraction.
+	ContinueOnError bool
+	// Stats, if not nil, is updated with the counts of the entries
+	// processed. It is not reset first.
+	Stats *ExtractStats
+	// Umask, if not nil, is cleared from the permissions of every file and
+	// directory extracted, including the parent directories created
+	// implicitly. When nil, the permissions in the tarball are used as is.
+	Umask *os.FileMode
+	// NormalizeSeparators replaces the backslashes in the names of the
+	// entries, and in the targets of links, with slashes, for tarballs
+	// created on Windows. It applies before any other option, and the
+	// normalized names are checked against escaping the destination.
+	NormalizeSeparators bool
+	// MaxWriteRetries is the number of times a write to a regular file
+	// failing with EINTR or EAGAIN, as happens on some network
+	// filesystems, is retried, with an increasing delay, before failing
+	// the extraction. Other errors are never retried.
+	MaxWriteRetries int
+	// OnProgress, if not nil, is called after each entry is extracted, and
+	// after OnEntry, with the progress of the extraction so far.
+	OnProgress func(p Progress)
+	// TotalSizeHint, if positive, is the expected size of the content of
+	// all the regular files, to compute the percentage of Progress.
+	TotalSizeHint int64
+	// MaxLinkLength is the length of the longest symlink target accepted.
+	// It defaults to DefaultMaxLinkLength.
+	MaxLinkLength int
+	// UnknownPAX says what to do with the entries having PAX records
+	// other than the ones of POSIX, the extended attributes and the GNU
+	// sparse maps, whether they are extracted or not. It defaults to
+	// IgnoreUnknownPAX.
+	UnknownPAX PAXPolicy
+	// ResumeFrom, if not empty, is the name in the tarball of the last
+	// entry extracted by an interrupted extraction. That entry and the
+	// ones before it are skipped, except that the modes and times of the
+	// directories among them are still applied at the end, and the
+	// extraction fails if it is not found. Resuming is only safe with the
+	// same tarball and options as the interrupted extraction.
+	ResumeFrom string
+	// ForceUID and ForceGID, if not nil, are the uid and gid to give every
+	// extracted file, whatever its header records and whether
+	// PreserveOwnership is set. Like PreserveOwnership, they are ignored
+	// when not running as root.
+	ForceUID *int
+	ForceGID *int
+	// PerEntryTimeout, if positive, limits the time spent reading the
+	// content of each entry. Extraction stops with ErrEntryTimeout once
+	// it is exceeded, even if the underlying reader is blocked, in which
+	// case it is left reading in the background.
+	PerEntryTimeout time.Duration
+	// DefaultDirMode is the mode of the parent directories created
+	// implicitly, for entries whose directories have no entry of their
+	// own. When zero, DEFAULT_DIR_MODE is used.
+	DefaultDirMode os.FileMode
+	// InheritParentMode gives the parent directories created implicitly
+	// the permissions of their nearest existing parent within the
+	// destination directory, or of the destination directory itself,
+	// instead of DefaultDirMode. DefaultDirMode is still used when that
+	// parent is a symlink, or when the destination does not exist.
+	InheritParentMode bool
+	// OnUnsupported, if not nil, is called for the entries of a type that
+	// is not extracted natively: unknown types, device nodes when not
+	// running as root, and types the Filesystem cannot create. r reads the
+	// content of the entry. Returning nil skips the entry, as handled,
+	// and returning an error stops the extraction.
+	OnUnsupported func(hdr *tar.Header, r io.Reader) error
+	// CanonicalizeModes replaces the permissions of the entries, for
+	// reproducible trees: 0755 for directories and the files their owner
+	// can execute, and 0644 for the other files. The setuid, setgid and
+	// sticky bits are dropped. Umask still applies.
+	CanonicalizeModes bool
+	// CleanupOnError removes what the extraction created when it fails
+	// after it started extracting entries, so that no partially extracted
+	// tree is left behind: the destination directory if it did not exist,
+	// and otherwise the paths created in it, including the files replaced
+	// by entries. What was in the directory before is left untouched. It
+	// is not supported with a Filesystem.
+	CleanupOnError bool
+	// ContentFilter, if not nil, is called with the header and the
+	// content of every regular file, and returns the reader of the
+	// content to write instead, such as one substituting placeholders.
+	// FileHashes are checked against their content in the tarball, which
+	// is read to the end whatever the filter reads of it.
+	ContentFilter func(hdr *tar.Header, r io.Reader) (io.Reader, error)
+	// RequireEndMarker fails the extraction with ErrTruncatedArchive when
+	// the tarball does not end with the two zero blocks of the
+	// end-of-archive marker, as when a download was cut short at an
+	// entry boundary. It needs ExtractTarReader, ExtractArchive or
+	// ExtractTarCounting, which read the stream themselves.
+	RequireEndMarker bool
+	// AtomicFiles writes each regular file to a temporary file in its
+	// directory, renamed to its path once its content, mode and owner are
+	// set, so that what is at the path is always either the previous
+	// file or the complete new one. It is not supported with a
+	// Filesystem.
+	AtomicFiles bool
+	// MetadataFilter, if not nil, is called with the header of every
+	// entry and returns the mode, uid and gid to give it instead of the
+	// ones of the header, overriding ForceUID, ForceGID,
+	// PreserveOwnership, CanonicalizeModes and Umask. Returning
+	// hdr.FileInfo().Mode(), hdr.Uid and hdr.Gid keeps the header's; a
+	// uid or gid of -1 leaves the current one. Only the permission,
+	// setuid, setgid and sticky bits of the mode are used. It is called
+	// once for each entry extracted, concurrently if Parallelism is set.
+	MetadataFilter func(hdr *tar.Header) (mode os.FileMode, uid, gid int)
+	// Metrics, if not nil, receives measurements of the extraction.
+	Metrics Metrics
+}
+
+// typeAllowed returns whether entries of type typ are in opts.AllowedTypes
+func (opts ExtractTarOptions) typeAllowed(typ byte) bool {
+	if opts.AllowedTypes == nil {
+		return true
+	}
+	if isRegular(typ) {
+		typ = tar.TypeReg
+	}
+	for _, t := range opts.AllowedTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// warn reports a problem that does not stop the extraction to opts.OnWarn, or
+// logs it
+func (opts ExtractTarOptions) warn(p string, err error) {
+	if opts.OnWarn != nil {
+		opts.OnWarn(p, err)
+		return
+	}
+	log.Printf("warning: %v", err)
+}
+
+// writeBufferSize returns the size of the buffer to write regular files with
+func (opts ExtractTarOptions) writeBufferSize() int {
+	if opts.WriteBufferSize <= 0 {
+		return DefaultWriteBufferSize
+	}
+	return opts.WriteBufferSize
+}
+
+// maxLinkLength returns the length of the longest symlink target accepted
+func (opts ExtractTarOptions) maxLinkLength() int {
+	if opts.MaxLinkLength > 0 {
+		return opts.MaxLinkLength
+	}
+	return DefaultMaxLinkLength
+}
+
+// permBits are the bits of an os.FileMode entries set with their mode
+const permBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// entryMeta is the permissions and owner to give an extracted entry
+type entryMeta struct {
+	perm os.FileMode
+	// uid and gid are -1 to keep the current ones
+	uid, gid int
+}
+
+// chown returns whether the owner of the entry is changed
+func (m entryMeta) chown() bool {
+	return m.uid != -1 || m.gid != -1
+}
+
+// metadata returns the permissions and owner to give the entry described by
+// hdr. MetadataFilter, if set, is called once.
+func (opts ExtractTarOptions) metadata(hdr *tar.Header) (entryMeta, error) {
+	if opts.MetadataFilter != nil {
+		mode, uid, gid := opts.MetadataFilter(hdr)
+		return entryMeta{mode & permBits, uid, gid}, nil
+	}
+	uid, gid, err := opts.owner(hdr)
+	if err != nil {
+		return entryMeta{}, err
+	}
+	return entryMeta{opts.entryPerm(hdr), uid, gid}, nil
+}
+
+// owner returns the uid and gid to give the entry described by hdr, -1
+// keeping the current one
+func (opts ExtractTarOptions) owner(hdr *tar.Header) (int, int, error) {
+	uid, gid := -1, -1
+	if opts.ForceUID != nil {
+		uid = *opts.ForceUID
+	} else if opts.PreserveOwnership {
+		var ok bool
+		if uid, ok = mapID(opts.UIDMap, hdr.Uid); !ok {
+			return 0, 0, fmt.Errorf("uid %d of %q is not mapped", hdr.Uid, hdr.Name)
+		}
+	}
+	if opts.ForceGID != nil {
+		gid = *opts.ForceGID
+	} else if opts.PreserveOwnership {
+		var ok bool
+		if gid, ok = mapID(opts.GIDMap, hdr.Gid); !ok {
+			return 0, 0, fmt.Errorf("gid %d of %q is not mapped", hdr.Gid, hdr.Name)
+		}
+	}
+	return uid, gid, nil
+}
+
+// implicitDirMode returns the mode to create the missing parents of p, in the
+// destination directory dir, with, lstat being used to find their nearest
+// existing parent. Only the parents within dir, or dir itself, are inherited
+// from; a symlink gets DefaultDirMode.
+func (opts ExtractTarOptions) implicitDirMode(lstat func(string) (os.FileInfo, error), dir, p string) os.FileMode {
+	mode := opts.DefaultDirMode
+	if mode == 0 {
+		mode = DEFAULT_DIR_MODE
+	}
+	if opts.InheritParentMode {
+		for ; p == filepath.Clean(dir) || below(dir, p); p = filepath.Dir(p) {
+			if fi, err := lstat(p); err == nil {
+				if fi.IsDir() {
+					mode = fi.Mode()
+				}
+				break
+			}
+		}
+	}
+	return opts.applyUmask(mode & os.ModePerm)
+}
+
+// entryPerm returns the permissions to extract the entry described by hdr
+// with, unless MetadataFilter is set
+func (opts ExtractTarOptions) entryPerm(hdr *tar.Header) os.FileMode {
+	if !opts.CanonicalizeModes {
+		return opts.applyUmask(entryMode(hdr))
+	}
+	if hdr.Typeflag == tar.TypeDir || hdr.Mode&0100 != 0 {
+		return opts.applyUmask(0755)
+	}
+	return opts.applyUmask(0644)
+}
+
+// applyUmask clears the bits of opts.Umask, if any, from the permissions in
+// mode
+func (opts ExtractTarOptions) applyUmask(mode os.FileMode) os.FileMode {
+	if opts.Umask == nil {
+		return mode
+	}
+	return mode &^ (*opts.Umask & os.ModePerm)
+}
+
+// OverwritePolicy says what to do when the path of an entry already exists.
+// Existing directories are merged with directory entries under any policy.
+type OverwritePolicy int
+
+const (
+	// OverwriteExisting removes what exists at the path of an entry, even
+	// if it is a directory, before extracting it
+	OverwriteExisting OverwritePolicy = iota
+	// SkipExisting leaves what exists untouched and skips the entry
+	SkipExisting
+	// ErrorOnExisting fails the extraction
+	ErrorOnExisting
+)
+
+// SyncPolicy says which of the extracted files are flushed to disk before
+// extraction goes on
+type SyncPolicy int
+
+const (
+	// SyncNone leaves flushing to the kernel, which is the fastest
+	SyncNone SyncPolicy = iota
+	// SyncFiles fsyncs each regular file before closing it. The content
+	// survives a crash, but the extraction waits for every file to reach
+	// the disk, which is typically many times slower.
+	SyncFiles
+	// SyncDir also fsyncs the parent directory of each entry, so that the
+	// entry itself survives a crash. It is the slowest, as every entry then
+	// costs at least one flush.
+	SyncDir
+)
+
+// IDMapping maps the Size ids starting at ContainerID onto the ids starting
+// at HostID, like a line of /proc/<pid>/uid_map does.
+type IDMapping struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// mapID translates id through the mappings in m. A nil m maps every id onto
+// itself.
+func mapID(m []IDMapping, id int) (int, bool) {
+	if m == nil {
+		return id, true
+	}
+	for _, e := range m {
+		if id >= e.ContainerID && id < e.ContainerID+e.Size {
+			return e.HostID + id - e.ContainerID, true
+		}
+	}
+	return 0, false
+}
+
 // ExtractTar extracts a tarball (from a tar.Reader) into the given directory
-// if pwl is not nil, only the paths in the map are extracted.
+// if pwl is not nil, only the paths in the map are extracted, see
+// ExtractTarOptions.Whitelist.
 func ExtractTar(tr *tar.Reader, dir string, pwl PathWhitelistMap) error {
-	um := syscall.Umask(0)
-	defer syscall.Umask(um)
+	e := Extractor{Options: ExtractTarOptions{Whitelist: pwl}}
+	return e.Extract(tr, dir)
+}
+
+// ExtractTarWithOptions extracts a tarball (from a tar.Reader) into the given
+// directory, as configured by opts.
+func ExtractTarWithOptions(tr *tar.Reader, dir string, opts ExtractTarOptions) error {
+	return ExtractTarContext(context.Background(), tr, dir, opts)
+}
+
+// ExtractTarContext is like ExtractTarWithOptions, but stops extracting and
+// returns ctx.Err() once ctx is done. Whatever was extracted by then is left
+// in place, unless opts.CleanupOnError is set.
+func ExtractTarContext(ctx context.Context, tr *tar.Reader, dir string, opts ExtractTarOptions) error {
+	return extractTar(ctx, tr, dir, opts, nil)
+}
+
+// ExtractTarReader is like ExtractTarWithOptions, but reads the uncompressed
+// tarball from r. See ExtractArchive for compressed tarballs.
+// Unlike with a tar.Reader, the content wrongly stored for directories, links,
+// devices and fifos is skipped, instead of being read as the next header, and
+// errors give the offset of the entry failing.
+func ExtractTarReader(r io.Reader, dir string, opts ExtractTarOptions) error {
+	return extractTarStream(r, dir, opts)
+}
+
+// ExtractTarCounting is like ExtractTarWithOptions, but the errors give the
+// offset of the entry failing.
+func ExtractTarCounting(ctr *CountingTarReader, dir string, opts ExtractTarOptions) error {
+	x := &extraction{
+		ctx:  context.Background(),
+		ctr:  ctr,
+		dir:  dir,
+		opts: opts,
+	}
+	return x.run(ctr.Reader)
+}
+
+// ExtractSubtree is like ExtractTarWithOptions, but only extracts the entries
+// whose cleaned name is prefix or is below it, and that opts.Whitelist also
+// matches if set. The content of the other entries is skipped unread. The
+// entries keep their full names; set opts.StripComponents to the number of
+// components of prefix to extract them relative to it instead.
+func ExtractSubtree(tr *tar.Reader, prefix, dir string, opts ExtractTarOptions) error {
+	opts.Whitelist = subtreeMatcher{splitPath(prefix), opts.Whitelist}
+	return ExtractTarWithOptions(tr, dir, opts)
+}
+
+// ExtractedEntry describes an entry of a tarball processed by
+// ExtractTarManifest
+type ExtractedEntry struct {
+	// Path is the location of the entry on disk
+	Path string
+	// Type is the tar type flag of the entry
+	Type byte
+	Size int64
+	Mode os.FileMode
+	// Skipped is set for entries that were not extracted as they are not
+	// in the whitelist, were filtered out by the options or already existed
+	Skipped bool
+}
+
+// Progress is the progress of an extraction, as reported to OnProgress
+type Progress struct {
+	// Entry is the header of the entry just extracted
+	Entry *tar.Header
+	// Written is the size of the content written so far
+	Written int64
+	// Total is the TotalSizeHint of the extraction
+	Total int64
+}
+
+// Percent returns the percentage of Total written so far, which stays at 100
+// if more than Total is written, or false if Total is not known
+func (p Progress) Percent() (float64, bool) {
+	if p.Total <= 0 {
+		return 0, false
+	}
+	if p.Written >= p.Total {
+		return 100, true
+	}
+	return float64(p.Written) * 100 / float64(p.Total), true
+}
+
+// ExtractStats counts the entries of a tarball processed by
+// ExtractTarWithOptions
+type ExtractStats struct {
+	// TotalBytes is the size of the content written
+	TotalBytes int64
+	// FileCount counts the regular files, hardlinks, devices and fifos
+	// extracted
+	FileCount    int
+	DirCount     int
+	SymlinkCount int
+	// SkippedCount counts the entries not extracted, as for
+	// ExtractedEntry.Skipped. They are not included in the other counts.
+	SkippedCount int
+}
+
+// ExtractTarManifest is like ExtractTarWithOptions, but also returns a
+// description of every entry of the tarball, in archive order.
+func ExtractTarManifest(tr *tar.Reader, dir string, opts ExtractTarOptions) ([]ExtractedEntry, error) {
+	var manifest []ExtractedEntry
+	err := extractTar(context.Background(), tr, dir, opts, &manifest)
+	return manifest, err
+}
+
+// extractTar implements ExtractTarContext, appending the entries processed to
+// manifest if it is not nil
+func extractTar(ctx context.Context, tr *tar.Reader, dir string, opts ExtractTarOptions, manifest *[]ExtractedEntry) error {
+	x := &extraction{
+		ctx:      ctx,
+		dir:      dir,
+		opts:     opts,
+		manifest: manifest,
+	}
+	return x.run(tr)
+}
+
+// run extracts the entries read from tr
+func (x *extraction) run(tr *tar.Reader) error {
+	if m := x.opts.Metrics; m != nil {
+		start := time.Now()
+		defer func() {
+			m.ObserveDuration(time.Since(start))
+		}()
+	}
+	if err := checkDestPrefix(x.opts.DestPrefix); err != nil {
+		return fmt.Errorf("error extracting tarball: %w", err)
+	}
+	if x.opts.StripCommonPrefix {
+		return errors.New("error extracting tarball: StripCommonPrefix needs ExtractTarReader or ExtractArchive")
+	}
+	if x.opts.RequireEndMarker && (x.ctr == nil || x.more != nil) {
+		return errors.New("error extracting tarball: RequireEndMarker needs ExtractTarReader, ExtractArchive or ExtractTarCounting")
+	}
+	x.dest = x.dir
+	if x.fs == nil {
+		// Anchor the extraction to where dir resolves now, should dir
+		// or its parents be symlinks
+		dir, err := resolveDir(x.dir)
+		if err != nil {
+			return fmt.Errorf("error extracting tarball: %w", err)
+		}
+		x.dir = dir
+		um := syscall.Umask(0)
+		defer syscall.Umask(um)
+	}
+	err := x.extractAll(tr)
+	if errors.Is(err, syscall.ENOSPC) {
+		err = fmt.Errorf("%w: %w", ErrNoSpace, err)
+	}
+	if err != nil && x.opts.CleanupOnError && x.fs == nil {
+		for p := range x.created {
+			if rerr := os.RemoveAll(p); rerr != nil {
+				return fmt.Errorf("%w (cleanup failed: %v)", err, rerr)
+			}
+		}
+	}
+	return err
+}
+
+// trackCreated records, if CleanupOnError is set, the path the extraction of
+// hdr creates: the destination directory or the first parent of the entry
+// missing, or else the entry itself when it replaces what exists there
+func (x *extraction) trackCreated(hdr *tar.Header) {
+	if !x.opts.CleanupOnError || x.fs != nil {
+		return
+	}
+	created := ""
+	if _, err := os.Lstat(x.dir); err != nil {
+		created = x.dir
+	} else {
+		p := x.dir
+		names := splitPath(hdr.Name)
+		for i, name := range names {
+			p = filepath.Join(p, name)
+			fi, err := os.Lstat(p)
+			if err != nil {
+				created = p
+				break
+			}
+			last := i == len(names)-1
+			if last && x.opts.Overwrite == OverwriteExisting && (!fi.IsDir() || hdr.Typeflag != tar.TypeDir) {
+				created = p
+			}
+		}
+	}
+	if created == "" {
+		return
+	}
+	// The workers of the pool extract entries concurrently
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.created == nil {
+		x.created = make(map[string]struct{})
+	}
+	x.created[created] = struct{}{}
+}
+
+// extractAll extracts the entries read from tr, and from the tarballs after it
+// if any
+func (x *extraction) extractAll(tr *tar.Reader) error {
+	if x.opts.Parallelism > 1 {
+		x.pool = newWorkerPool(x.opts.Parallelism)
+		defer x.pool.close()
+	}
+	ctx := x.ctx
+	next := tr.Next
+	if x.ctr != nil {
+		next = x.ctr.Next
+	}
 	for {
-		hdr, err := tr.Next()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := next()
 		switch err {
 		case io.EOF:
+			if x.more != nil {
+				more, err := x.more()
+				if err != nil {
+					return fmt.Errorf("error extracting tarball: %w", err)
+				}
+				if more != nil {
+					tr, next = more, more.Next
+					// The entries of a tarball may replace the
+					// directories of the previous ones
+					x.parents = nil
+					continue
+				}
+			}
+			if x.opts.RequireEndMarker && !x.ctr.endMarker() {
+				return fmt.Errorf("error extracting tarball: %w: no end-of-archive marker at offset %d", ErrTruncatedArchive, x.ctr.CurrentOffset())
+			}
+			if x.opts.ResumeFrom != "" && !x.resumed {
+				return fmt.Errorf("error extracting tarball: entry %q to resume from not found", x.opts.ResumeFrom)
+			}
+			if err := x.finish(); err != nil {
+				return err
+			}
+			if len(x.errs) > 0 {
+				return fmt.Errorf("error extracting tarball: %w", x.errs)
+			}
 			return nil
 		case nil:
-			if pwl != nil {
-				relpath := filepath.Clean(hdr.Name)
-				if _, ok := pwl[relpath]; !ok {
-					continue
+			if err := x.extractEntry(tr, hdr); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if x.ctr != nil {
+					return fmt.Errorf("error at entry %q (offset %d): %w", hdr.Name, x.ctr.CurrentOffset(), err)
 				}
+				return err
 			}
-			err = ExtractFile(tr, hdr, dir)
-			if err != nil {
-				return fmt.Errorf("error extracting tarball: %v", err)
+		default:
+			if x.ctr != nil {
+				return fmt.Errorf("error extracting tarball at offset %d: %w", x.ctr.CurrentOffset(), err)
 			}
+			return fmt.Errorf("error extracting tarball: %w", err)
+		}
+	}
+}
+
+// extraction holds the state of an extraction by extractTar
+type extraction struct {
+	ctx context.Context
+	// fs, if not nil, is where to extract instead of the OS filesystem, see
+	// filesystem
+	fs Filesystem
+	// ctr, if not nil, is the reader of the tarball, whose offsets are
+	// given in errors
+	ctr *CountingTarReader
+	// more, if not nil, returns the reader of the tarball following the
+	// one read, or nil if there is none
+	more func() (*tar.Reader, error)
+	// dir is the destination directory, with its symlinks resolved, and
+	// dest the destination directory as given, for the manifest
+	dir      string
+	dest     string
+	opts     ExtractTarOptions
+	manifest *[]ExtractedEntry
+
+	// dirs are the directories whose mode, and times if RestoreTimes is
+	// set, are applied once all is extracted
+	dirs []dirEntry
+	// links are the hardlinks deferred until their target is extracted
+	links []deferredLink
+	// seen are the paths extracted so far, if DetectDuplicates is set
+	seen    map[string]struct{}
+	total   int64
+	entries int
+	// linkCount is the number of links extracted or deferred so far
+	linkCount int
+	// written is the size of the content written so far
+	written int64
+	// resumed is whether the entry to resume from was read
+	resumed bool
+
+	// pool writes regular files concurrently, if Parallelism is set
+	pool *workerPool
+	// mu guards the recording of the entries extracted, and errs
+	mu sync.Mutex
+	// errs are the entries that failed, if ContinueOnError is set
+	errs EntryErrors
+	// layer are the paths extracted so far and their parent directories,
+	// if ApplyWhiteouts is set
+	layer map[string]struct{}
+	// parents are the parent directories of the entries extracted so far
+	parents map[string]struct{}
+	// created are the paths to remove should the extraction fail, if
+	// CleanupOnError is set, see trackCreated
+	created map[string]struct{}
+}
+
+// dirEntry is a directory extracted, with the permissions to give it
+type dirEntry struct {
+	hdr  *tar.Header
+	perm os.FileMode
+}
+
+// deferredLink is a hardlink, with its original and relocated header
+type deferredLink struct {
+	orig, hdr *tar.Header
+}
+
+// extractEntry extracts the entry described by hdr, with its content read
+// from tr
+func (x *extraction) extractEntry(tr *tar.Reader, hdr *tar.Header) error {
+	x.entries++
+	if x.opts.MaxEntries > 0 && x.entries > x.opts.MaxEntries {
+		return ErrTooManyEntries
+	}
+	if x.opts.NormalizeSeparators {
+		hdr = normalizeSeparators(hdr)
+	}
+	if err := checkName(hdr); err != nil {
+		return fmt.Errorf("error extracting tarball: %w", &EntryError{Path: hdr.Name, Err: err})
+	}
+	if x.opts.ResumeFrom != "" && !x.resumed {
+		x.resumed = filepath.Clean(hdr.Name) == filepath.Clean(x.opts.ResumeFrom)
+		return x.skipExtracted(hdr)
+	}
+	if x.opts.UnknownPAX == RejectUnknownPAX {
+		if keys := unknownPAXRecords(hdr); len(keys) > 0 {
+			err := fmt.Errorf("unknown PAX records %s", strings.Join(keys, ", "))
+			return fmt.Errorf("error extracting tarball: %w", &EntryError{Path: hdr.Name, Err: err})
+		}
+	}
+	if x.opts.Whitelist != nil && !x.opts.Whitelist.Match(filepath.Clean(hdr.Name)) {
+		x.record(hdr, true)
+		return nil
+	}
+	orig := hdr
+	hdr, ok, err := x.opts.relocate(hdr)
+	if err != nil {
+		return fmt.Errorf("error extracting tarball: %w", err)
+	}
+	if !ok {
+		x.record(orig, true)
+		return nil
+	}
+	if x.opts.ApplyWhiteouts && isWhiteout(hdr) {
+		if err := x.applyWhiteout(hdr); err != nil {
+			return err
+		}
+		x.record(hdr, true)
+		return nil
+	}
+	if !x.opts.typeAllowed(hdr.Typeflag) {
+		if x.opts.StrictTypes {
+			err := fmt.Errorf("%w: %v", ErrTypeNotAllowed, hdr.Typeflag)
+			return fmt.Errorf("error extracting tarball: %w", &EntryError{Path: hdr.Name, Err: err})
+		}
+		x.record(hdr, true)
+		return nil
+	}
+	if x.opts.OnUnsupported != nil && !x.handles(hdr.Typeflag) {
+		if err := x.opts.OnUnsupported(hdr, x.entryReader(tr)); err != nil {
+			return fmt.Errorf("error extracting tarball: %w", &EntryError{Path: hdr.Name, Err: err})
+		}
+		x.record(hdr, true)
+		return nil
+	}
+	// The tar reader skips the content left unread
+	if x.opts.SkeletonOnly && hdr.Typeflag != tar.TypeDir {
+		x.record(hdr, true)
+		return nil
+	}
+	if x.opts.DetectDuplicates {
+		name := filepath.Clean(hdr.Name)
+		if _, ok := x.seen[name]; ok {
+			return fmt.Errorf("error extracting tarball: duplicate entry %q", name)
+		}
+		if x.seen == nil {
+			x.seen = make(map[string]struct{})
+		}
+		x.seen[name] = struct{}{}
+	}
+	if isRegular(hdr.Typeflag) && x.opts.MaxFileSize > 0 && hdr.Size > x.opts.MaxFileSize {
+		err := fileTooLarge(hdr.Name, x.opts.MaxFileSize)
+		return fmt.Errorf("error extracting tarball: %w", &EntryError{Path: hdr.Name, Err: err})
+	}
+	if isRegular(hdr.Typeflag) {
+		x.total += hdr.Size
+		if x.opts.MaxTotalBytes > 0 && x.total > x.opts.MaxTotalBytes {
+			return ErrSizeLimitExceeded
+		}
+	}
+	if hdr.Typeflag == tar.TypeLink || hdr.Typeflag == tar.TypeSymlink {
+		x.linkCount++
+		if x.opts.MaxLinks > 0 && x.linkCount > x.opts.MaxLinks {
+			return ErrTooManyLinks
+		}
+	}
+	if x.opts.ApplyWhiteouts {
+		x.addToLayer(hdr.Name)
+	}
+	if err := x.checkConflict(hdr); err != nil {
+		return fmt.Errorf("error extracting tarball: %w", &EntryError{Path: hdr.Name, Err: err})
+	}
+	if x.opts.DeferredHardlinks && hdr.Typeflag == tar.TypeLink && !x.exists(hdr.Linkname) {
+		x.links = append(x.links, deferredLink{orig, hdr})
+		return nil
+	}
+	if err := x.countFlattened(hdr); err != nil {
+		return err
+	}
+	if x.pool != nil {
+		return x.pool.extract(x, tr, orig, hdr)
+	}
+	return x.extractFile(x.entryReader(tr), orig, hdr)
+}
+
+// checkConflict returns an error wrapping ErrPathConflict if the entry
+// described by hdr is not a directory but earlier entries of its tarball are
+// below it, and records its parent directories otherwise, see
+// recordParents. Entries below an earlier file are caught when creating
+// their parents.
+func (x *extraction) checkConflict(hdr *tar.Header) error {
+	if x.parents == nil {
+		x.parents = make(map[string]struct{})
+	}
+	return recordParents(x.parents, hdr)
+}
+
+// recordParents returns an error wrapping ErrPathConflict if the entry
+// described by hdr is not a directory but is one of parents, the parent
+// directories of the earlier entries, and adds its own parents to them
+// otherwise
+func recordParents(parents map[string]struct{}, hdr *tar.Header) error {
+	name := filepath.Clean(hdr.Name)
+	if _, ok := parents[name]; ok && hdr.Typeflag != tar.TypeDir {
+		return fmt.Errorf("%w: %q is the directory of earlier entries, but its entry is not a directory", ErrPathConflict, name)
+	}
+	for p := filepath.Dir(name); p != "." && p != "/"; p = filepath.Dir(p) {
+		if _, ok := parents[p]; ok {
+			break
+		}
+		parents[p] = struct{}{}
+	}
+	return nil
+}
+
+// skipExtracted skips the entry described by hdr, which was extracted before
+// ResumeFrom. A directory still gets its mode applied at the end.
+func (x *extraction) skipExtracted(hdr *tar.Header) error {
+	x.record(hdr, true)
+	if hdr.Typeflag != tar.TypeDir {
+		return nil
+	}
+	h, ok, err := x.opts.relocate(hdr)
+	if err != nil {
+		return fmt.Errorf("error extracting tarball: %w", err)
+	}
+	if !ok || !x.exists(h.Name) {
+		return nil
+	}
+	meta, err := x.opts.metadata(h)
+	if err != nil {
+		return fmt.Errorf("error extracting tarball: %w", &EntryError{Path: h.Name, Err: err})
+	}
+	x.dirs = append(x.dirs, dirEntry{h, meta.perm})
+	return nil
+}
+
+// extractFile extracts the relocated entry hdr, of the original header orig,
+// and records it
+func (x *extraction) extractFile(r io.Reader, orig, hdr *tar.Header) error {
+	var written int64
+	meta, err := x.opts.metadata(hdr)
+	if err == nil {
+		x.trackCreated(hdr)
+		written, err = extractFile(x.filesystem(), r, hdr, meta, x.dir, x.opts)
+	}
+	if err == errEntrySkipped {
+		x.record(hdr, true)
+		return nil
+	}
+	if err != nil {
+		entryErr := &EntryError{Path: hdr.Name, Err: err}
+		if x.opts.ContinueOnError {
+			x.mu.Lock()
+			x.errs = append(x.errs, entryErr)
+			x.mu.Unlock()
+			return nil
+		}
+		return fmt.Errorf("error extracting tarball: %w", entryErr)
+	}
+	x.record(hdr, false)
+	// The workers of the pool complete entries concurrently
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.opts.Stats != nil {
+		x.opts.Stats.TotalBytes += written
+	}
+	if x.opts.OnEntry != nil {
+		x.opts.OnEntry(orig, written)
+	}
+	if m := x.opts.Metrics; m != nil {
+		m.IncFiles()
+		if written > 0 {
+			m.AddBytes(written)
+		}
+	}
+	x.written += written
+	if x.opts.OnProgress != nil {
+		x.opts.OnProgress(Progress{Entry: orig, Written: x.written, Total: x.opts.TotalSizeHint})
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		x.dirs = append(x.dirs, dirEntry{hdr, meta.perm})
+	} else {
+		x.dropDirs(hdr.Name)
+	}
+	return nil
+}
+
+// dropDirs removes the directory name, replaced by another entry, and the
+// ones below it from the directories finish applies the modes of. x.mu must
+// be held.
+func (x *extraction) dropDirs(name string) {
+	name = filepath.Clean(name)
+	dirs := x.dirs[:0]
+	for _, d := range x.dirs {
+		if n := filepath.Clean(d.hdr.Name); n != name && !strings.HasPrefix(n, name+"/") {
+			dirs = append(dirs, d)
+		}
+	}
+	x.dirs = dirs
+}
+
+// finish completes the extraction once all entries are read
+func (x *extraction) finish() error {
+	if x.pool != nil {
+		if err := x.pool.wait(); err != nil {
+			return err
+		}
+	}
+	// Deferred hardlinks may point to each other, so retry them until no
+	// more can be created
+	for len(x.links) > 0 {
+		var pending []deferredLink
+		for _, l := range x.links {
+			if !x.exists(l.hdr.Linkname) {
+				pending = append(pending, l)
+				continue
+			}
+			if err := x.countFlattened(l.hdr); err != nil {
+				return err
+			}
+			if err := x.extractFile(eofReader{}, l.orig, l.hdr); err != nil {
+				return err
+			}
+		}
+		if len(pending) == len(x.links) {
+			l := pending[0].hdr
+			return fmt.Errorf("error extracting tarball: target of hardlink %q -> %q not found", l.Name, l.Linkname)
+		}
+		x.links = pending
+	}
+	// Directories may be extracted before or after their content, are
+	// implicitly created with DEFAULT_DIR_MODE, and explicitly with a mode
+	// writable by their owner, so their modes are applied once all is
+	// extracted. The deepest go first, so that a parent
+	// losing its search permission does not prevent changing its children.
+	sort.SliceStable(x.dirs, func(i, j int) bool {
+		return depth(x.dirs[i].hdr.Name) > depth(x.dirs[j].hdr.Name)
+	})
+	for _, d := range x.dirs {
+		p := filepath.Join(x.dir, d.hdr.Name)
+		if err := finishDir(x.filesystem(), x.dir, p, d.hdr, d.perm, x.opts); err != nil {
+			return fmt.Errorf("error extracting tarball: %w", err)
+		}
+	}
+	return x.clampParents()
+}
+
+// clampParents gives the parent directories of the entries extracted, which
+// may have been created implicitly, the time of ClampMTime if it is set
+func (x *extraction) clampParents() error {
+	t := x.opts.ClampMTime
+	if t == nil {
+		return nil
+	}
+	fs := x.filesystem()
+	for name := range x.parents {
+		p := filepath.Join(x.dir, name)
+		// What failed to extract with ContinueOnError may be missing, or
+		// be below a symlink it was not extracted through
+		if checkParentsIn(fs, x.dir, p) != nil {
+			continue
+		}
+		err := fs.Chtimes(p, *t, *t)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error extracting tarball: %w", err)
+		}
+	}
+	return nil
+}
+
+// countFlattened adds the size of the copy made for the hardlink described by
+// hdr, if FlattenHardlinks is set, to the total size extracted
+func (x *extraction) countFlattened(hdr *tar.Header) error {
+	if !x.opts.FlattenHardlinks || hdr.Typeflag != tar.TypeLink {
+		return nil
+	}
+	fi, err := os.Lstat(filepath.Join(x.dir, hdr.Linkname))
+	if err != nil || !fi.Mode().IsRegular() {
+		// Extraction reports it
+		return nil
+	}
+	x.total += fi.Size()
+	if x.opts.MaxTotalBytes > 0 && x.total > x.opts.MaxTotalBytes {
+		return ErrSizeLimitExceeded
+	}
+	return nil
+}
+
+// record appends the entry described by hdr to the manifest and counts it in
+// the stats, if any
+func (x *extraction) record(hdr *tar.Header, skipped bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.manifest != nil {
+		*x.manifest = append(*x.manifest, newExtractedEntry(hdr, x.dest, skipped))
+	}
+	if st := x.opts.Stats; st != nil {
+		switch {
+		case skipped:
+			st.SkippedCount++
+		case hdr.Typeflag == tar.TypeDir:
+			st.DirCount++
+		case hdr.Typeflag == tar.TypeSymlink:
+			st.SymlinkCount++
 		default:
-			return fmt.Errorf("error extracting tarball: %v", err)
+			st.FileCount++
+		}
+	}
+}
+
+// depth returns the number of components of the cleaned path name
+func depth(name string) int {
+	return len(splitPath(name))
+}
+
+// exists returns whether name, relative to the destination directory, exists
+func (x *extraction) exists(name string) bool {
+	_, err := x.filesystem().Lstat(filepath.Join(x.dir, name))
+	return err == nil
+}
+
+// filesystem returns the Filesystem x extracts to
+func (x *extraction) filesystem() Filesystem {
+	if x.fs == nil {
+		return osFS{}
+	}
+	return x.fs
+}
+
+// relocate returns hdr, or a copy of it with its name (and hardlink target)
+// rewritten as configured by opts. It returns false for entries that should be
+// skipped.
+func (opts ExtractTarOptions) relocate(hdr *tar.Header) (*tar.Header, bool, error) {
+	if opts.StripComponents <= 0 && opts.Rename == nil && len(opts.Exclude) == 0 && opts.DestPrefix == "" {
+		return hdr, true, nil
+	}
+	name, ok, err := opts.relocateName(hdr.Name)
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	h := *hdr
+	h.Name = name
+	if h.Typeflag == tar.TypeLink {
+		h.Linkname, ok, err = opts.relocateName(hdr.Linkname)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			return nil, false, fmt.Errorf("target of hardlink %q -> %q is skipped", hdr.Name, hdr.Linkname)
+		}
+	}
+	return &h, true, nil
+}
+
+// relocateName applies StripComponents, Rename, Exclude and then DestPrefix to
+// name
+func (opts ExtractTarOptions) relocateName(name string) (string, bool, error) {
+	name = filepath.Clean(name)
+	if opts.StripComponents > 0 {
+		var ok bool
+		if name, ok = stripComponents(name, opts.StripComponents); !ok {
+			return "", false, nil
+		}
+	}
+	if opts.Rename != nil {
+		newName, ok := opts.Rename(name)
+		if !ok {
+			return "", false, nil
+		}
+		if filepath.IsAbs(newName) {
+			return "", false, fmt.Errorf("entry %q renamed to absolute path %q", name, newName)
+		}
+		name = newName
+	}
+	if len(opts.Exclude) > 0 && excluded(opts.Exclude, name) {
+		return "", false, nil
+	}
+	if opts.DestPrefix != "" {
+		name = filepath.Join(opts.DestPrefix, name)
+	}
+	return name, true, nil
+}
+
+// resolveDir returns the absolute path of dir with its symlinks resolved. The
+// part of dir that does not exist yet is kept as is.
+func resolveDir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if os.IsNotExist(err) && filepath.Dir(abs) != abs {
+		parent, err := resolveDir(filepath.Dir(abs))
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(parent, filepath.Base(abs)), nil
+	}
+	return real, err
+}
+
+// checkDestPrefix returns an error if prefix is not a relative path within
+// the destination directory
+func checkDestPrefix(prefix string) error {
+	if filepath.IsAbs(prefix) {
+		return fmt.Errorf("absolute DestPrefix %q", prefix)
+	}
+	for _, c := range strings.Split(prefix, "/") {
+		if c == ".." {
+			return fmt.Errorf("DestPrefix %q contains \"..\"", prefix)
 		}
 	}
+	return nil
+}
+
+// normalizeSeparators returns a copy of hdr with the backslashes in its name,
+// and in its link target, replaced by slashes
+func normalizeSeparators(hdr *tar.Header) *tar.Header {
+	h := *hdr
+	h.Name = strings.Replace(h.Name, "\\", "/", -1)
+	if h.Typeflag == tar.TypeLink || h.Typeflag == tar.TypeSymlink {
+		h.Linkname = strings.Replace(h.Linkname, "\\", "/", -1)
+	}
+	return &h
+}
+
+// stripComponents removes the first n components of name, returning false
+// if nothing remains
+func stripComponents(name string, n int) (string, bool) {
+	parts := strings.Split(strings.Trim(filepath.Clean(name), "/"), "/")
+	if len(parts) <= n {
+		return "", false
+	}
+	return filepath.Join(parts[n:]...), true
+}
+
+func newExtractedEntry(hdr *tar.Header, dir string, skipped bool) ExtractedEntry {
+	return ExtractedEntry{
+		Path:    filepath.Join(dir, hdr.Name),
+		Type:    hdr.Typeflag,
+		Size:    hdr.Size,
+		Mode:    hdr.FileInfo().Mode(),
+		Skipped: skipped,
+	}
 }
 
 // ExtractFile extracts the file described by hdr fom the given tarball into
 // the provided directory
 func ExtractFile(tr *tar.Reader, hdr *tar.Header, dir string) error {
+	if err := checkName(hdr); err != nil {
+		return &EntryError{Path: hdr.Name, Err: err}
+	}
+	fs := osFS{}
+	meta, err := ExtractTarOptions{}.metadata(hdr)
+	if err == nil {
+		_, err = extractFile(fs, tr, hdr, meta, dir, ExtractTarOptions{})
+	}
+	if err == errEntrySkipped {
+		return nil
+	}
+	if err == nil && hdr.Typeflag == tar.TypeDir {
+		err = fs.Chmod(filepath.Join(dir, hdr.Name), meta.perm)
+	}
+	if err != nil {
+		return &EntryError{Path: hdr.Name, Err: err}
+	}
+	return nil
+}
+
+// extractFile extracts the file described by hdr to dir of fs, with its
+// content read from r and the permissions and owner of meta, as configured by
+// opts. It returns the number of bytes of content written, or errEntrySkipped
+// if the options caused the entry not to be extracted.
+func extractFile(fs Filesystem, r io.Reader, hdr *tar.Header, meta entryMeta, dir string, opts ExtractTarOptions) (int64, error) {
 	p := filepath.Join(dir, hdr.Name)
-	fi := hdr.FileInfo()
+	perm := meta.perm
 	typ := hdr.Typeflag
+	// Directories get their mode once their content is extracted, and
+	// until then must be writable, such as a 0555 one with files in it
+	if typ == tar.TypeDir {
+		perm |= 0700
+	}
+	var written int64
+
+	if err := checkEntry(hdr, opts); err != nil {
+		return 0, err
+	}
+	if err := checkInside(dir, p); err != nil {
+		return 0, err
+	}
+	if typ == tar.TypeLink {
+		if err := checkInside(dir, filepath.Join(dir, hdr.Linkname)); err != nil {
+			return 0, err
+		}
+	}
+	if err := checkParentsIn(fs, dir, p); err != nil {
+		return 0, err
+	}
+	// Link follows the symlinks in the path of the target
+	if typ == tar.TypeLink {
+		if err := checkParentsIn(fs, dir, filepath.Join(dir, hdr.Linkname)); err != nil {
+			return 0, err
+		}
+	}
+	wantHash, hashed := opts.FileHashes[filepath.Clean(hdr.Name)]
+	if isRegular(typ) && opts.StrictHashes && !hashed {
+		return 0, fmt.Errorf("no hash for %q", hdr.Name)
+	}
 
 	// Create parent dir if it doesn't exists
-	if err := os.MkdirAll(filepath.Dir(p), DEFAULT_DIR_MODE); err != nil {
-		return err
+	if err := mkdirAllFS(fs, dir, filepath.Dir(p), opts.implicitDirMode(fs.Lstat, dir, filepath.Dir(p))); err != nil {
+		return 0, err
 	}
-	switch {
-	case typ == tar.TypeReg || typ == tar.TypeRegA:
-		if err := os.MkdirAll(filepath.Dir(p), DEFAULT_DIR_MODE); err != nil {
-			return err
+	final := p
+	// AtomicFiles, like the other options rejected by checkFSOptions, is
+	// only supported by the OS filesystem
+	if opts.AtomicFiles && isRegular(typ) {
+		if err := handleExistingAtomic(fs, p, opts.Overwrite); err != nil {
+			return 0, err
 		}
-		f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, fi.Mode())
+		tmp, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".tmp-")
 		if err != nil {
-			return err
+			return 0, err
 		}
-		_, err = io.Copy(f, tr)
-		if err != nil {
-			f.Close()
-			return err
+		tmp.Close()
+		p = tmp.Name()
+		// A no-op once renamed
+		defer os.Remove(p)
+	} else if err := handleExisting(fs, p, typ, opts.Overwrite); err != nil {
+		return 0, err
+	}
+	switch {
+	case isRegular(typ):
+		var h hash.Hash
+		if hashed {
+			h = sha256.New()
+			r = io.TeeReader(r, h)
 		}
-		f.Close()
-	case typ == tar.TypeDir:
-		if err := os.MkdirAll(p, fi.Mode()); err != nil {
-			return err
+		var err error
+		if written, err = writeFile(fs, p, perm, r, hdr, opts); err != nil {
+			return 0, err
 		}
-		dir, err := os.Open(p)
-		if err != nil {
-			return err
+		if h != nil {
+			if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, wantHash) {
+				fs.Remove(p)
+				return 0, fmt.Errorf("hash mismatch for %q: expected sha256 %s, got %s", hdr.Name, wantHash, got)
+			}
 		}
-		if err := dir.Chmod(fi.Mode()); err != nil {
-			dir.Close()
-			return err
+	case typ == tar.TypeDir:
+		// Anything but a directory was removed by handleExisting
+		if _, err := fs.Lstat(p); os.IsNotExist(err) {
+			if err := fs.Mkdir(p, perm); err != nil {
+				return 0, err
+			}
+		} else if err != nil {
+			return 0, err
 		}
-		dir.Close()
 	case typ == tar.TypeLink:
 		dest := filepath.Join(dir, hdr.Linkname)
-		if !strings.HasPrefix(dest, dir) {
-			return insecureLinkError(fmt.Errorf("insecure link %q -> %q", p, hdr.Linkname))
+		if opts.FlattenHardlinks {
+			var err error
+			if written, err = flattenLink(dest, p); err != nil {
+				return 0, err
+			}
+			break
 		}
-		if err := os.Link(dest, p); err != nil {
-			return err
+		if err := fs.Link(dest, p); err != nil {
+			return 0, err
 		}
 	case typ == tar.TypeSymlink:
-		dest := filepath.Join(filepath.Dir(p), hdr.Linkname)
-		if !strings.HasPrefix(dest, dir) {
-			return insecureLinkError(fmt.Errorf("insecure symlink %q -> %q", p, hdr.Linkname))
+		target := hdr.Linkname
+		if opts.RebaseAbsoluteLinks && filepath.IsAbs(target) {
+			target = rebaseLink(hdr.Name, target)
 		}
-		if err := os.Symlink(hdr.Linkname, p); err != nil {
-			return err
+		if err := fs.Symlink(target, p); err != nil {
+			return 0, err
 		}
-	case typ == tar.TypeChar:
-		dev := makedev(int(hdr.Devmajor), int(hdr.Devminor))
-		mode := uint32(fi.Mode()) | syscall.S_IFCHR
-		if err := syscall.Mknod(p, mode, dev); err != nil {
-			return err
+	case typ == tar.TypeChar || typ == tar.TypeBlock:
+		nfs, ok := fs.(nodeFS)
+		if !ok {
+			return 0, fmt.Errorf("%w: %v", ErrUnsupportedType, typ)
+		}
+		if opts.SkipDevices && os.Geteuid() != 0 {
+			opts.warn(p, fmt.Errorf("skipping device node %q: not running as root", p))
+			return 0, errEntrySkipped
 		}
-	case typ == tar.TypeBlock:
 		dev := makedev(int(hdr.Devmajor), int(hdr.Devminor))
-		mode := uint32(fi.Mode()) | syscall.S_IFBLK
-		if err := syscall.Mknod(p, mode, dev); err != nil {
-			return err
+		// The special mode bits are set by the final chmod
+		mode := uint32(perm.Perm()) | syscall.S_IFCHR
+		if typ == tar.TypeBlock {
+			mode = uint32(perm.Perm()) | syscall.S_IFBLK
+		}
+		if err := nfs.Mknod(p, mode, dev); err != nil {
+			return 0, err
 		}
+	case typ == tar.TypeFifo:
+		nfs, ok := fs.(nodeFS)
+		if !ok {
+			return 0, fmt.Errorf("%w: %v", ErrUnsupportedType, typ)
+		}
+		if err := nfs.Mkfifo(p, uint32(perm.Perm())); err != nil {
+			return 0, err
+		}
+	// Sockets are never archived, as tar has no type for them
 	// TODO(jonboulle): implement other modes
 	default:
-		return fmt.Errorf("unsupported type: %v", typ)
+		return 0, fmt.Errorf("%w: %v", ErrUnsupportedType, typ)
 	}
 
+	// Hardlinks share the inode, and thus the owner, of their target
+	if typ != tar.TypeLink && meta.chown() {
+		err := fs.Chown(p, meta.uid, meta.gid)
+		switch {
+		case errors.Is(err, errNotRoot):
+			if opts.OnWarn != nil {
+				opts.OnWarn(p, fmt.Errorf("not changing owner of %q: %w", p, err))
+			}
+		case err != nil:
+			return 0, err
+		}
+	}
+
+	// Changing the owner drops the setuid and setgid bits, and the umask or
+	// the open flags may have dropped them at creation, so set the mode
+	// again. Symlinks have no mode of their own.
+	if typ != tar.TypeLink && typ != tar.TypeSymlink {
+		if err := fs.Chmod(p, perm); err != nil {
+			return 0, err
+		}
+	}
+
+	// Set after changing the owner, which drops security.capability
+	if opts.RestoreXattrs && typ != tar.TypeLink {
+		if err := restoreXattrs(p, hdr, opts); err != nil {
+			return 0, err
+		}
+	}
+
+	if typ != tar.TypeLink && typ != tar.TypeDir {
+		if err := restoreTimes(fs, p, hdr, opts); err != nil {
+			return 0, err
+		}
+	}
+
+	if p != final {
+		if err := os.Rename(p, final); err != nil {
+			return 0, err
+		}
+		p = final
+	}
+
+	if opts.Sync >= SyncDir {
+		if err := syncDir(filepath.Dir(p)); err != nil {
+			return 0, err
+		}
+	}
+
+	return written, nil
+}
+
+// rebaseLink returns the relative target of a symlink named name pointing to
+// the absolute target, both being paths relative to the root of the tarball
+func rebaseLink(name, target string) string {
+	rel, err := filepath.Rel(filepath.Dir(filepath.Join("/", name)), filepath.Clean(target))
+	if err != nil {
+		// Both paths are absolute, so this cannot happen
+		return target
+	}
+	return rel
+}
+
+// writeFile creates the regular file p of fs with the content of the entry
+// described by hdr, read from r, and returns the number of bytes written
+func writeFile(fs Filesystem, p string, perm os.FileMode, r io.Reader, hdr *tar.Header, opts ExtractTarOptions) (int64, error) {
+	f, err := fs.Create(p, perm)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r, err = opts.filterContent(hdr, r)
+	if err != nil {
+		return 0, err
+	}
+	var w io.Writer = f
+	// Holes need files that can seek, such as the ones of the OS
+	sf, sparse := f.(sparseFile)
+	sparse = sparse && (opts.SparseAware || isSparse(hdr))
+	if sparse {
+		w = &sparseWriter{f: sf}
+	}
+	if opts.MaxWriteRetries > 0 {
+		w = retryWriter{w, opts.MaxWriteRetries}
+	}
+	// Read a byte more than allowed to tell the content exceeds it
+	if opts.MaxFileSize > 0 {
+		r = io.LimitReader(r, opts.MaxFileSize+1)
+	}
+	bw := getWriter(w, opts.writeBufferSize())
+	defer putWriter(bw)
+	// Hide bw.ReadFrom, which bypasses the buffer when it is empty
+	written, err := io.Copy(writerOnly{bw}, r)
+	if err != nil {
+		return 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	if opts.MaxFileSize > 0 && written > opts.MaxFileSize {
+		f.Close()
+		fs.Remove(p)
+		return 0, fileTooLarge(hdr.Name, opts.MaxFileSize)
+	}
+	// Trailing holes were only seeked over, so set the size
+	if sparse {
+		if err := sf.Truncate(written); err != nil {
+			return 0, err
+		}
+	}
+	// Sync, like the other options rejected by checkFSOptions, is only
+	// supported by the OS filesystem
+	if sync, ok := f.(interface{ Sync() error }); ok && opts.Sync >= SyncFiles {
+		if err := sync.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	return written, f.Close()
+}
+
+// filterContent returns the reader of the content to write for the regular
+// file described by hdr, of content r, as replaced by opts.ContentFilter
+func (opts ExtractTarOptions) filterContent(hdr *tar.Header, r io.Reader) (io.Reader, error) {
+	if opts.ContentFilter == nil {
+		return r, nil
+	}
+	fr, err := opts.ContentFilter(hdr, r)
+	if err != nil {
+		return nil, fmt.Errorf("error filtering content of %q: %w", hdr.Name, err)
+	}
+	// Read what the filter left of the content too, for the hash
+	return io.MultiReader(fr, drainReader{r}), nil
+}
+
+// drainReader reads r to the end, discarding it, and then returns io.EOF
+type drainReader struct {
+	r io.Reader
+}
+
+func (dr drainReader) Read([]byte) (int, error) {
+	if _, err := io.Copy(ioutil.Discard, dr.r); err != nil {
+		return 0, err
+	}
+	return 0, io.EOF
+}
+
+// fileTooLarge returns the error for the file name exceeding limit
+func fileTooLarge(name string, limit int64) error {
+	return fmt.Errorf("%w: %q is larger than %d bytes", ErrFileTooLarge, name, limit)
+}
+
+// writerOnly hides the methods of an io.Writer other than Write
+type writerOnly struct {
+	io.Writer
+}
+
+// flattenLink makes p a copy of target, with its mode and, when running as
+// root, its owner. A symlink target is copied as a symlink, so that it is not
+// followed. It returns the number of bytes copied.
+func flattenLink(target, p string) (int64, error) {
+	fi, err := os.Lstat(target)
+	if err != nil {
+		return 0, err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(target)
+		if err != nil {
+			return 0, err
+		}
+		return 0, os.Symlink(link, p)
+	}
+	if !fi.Mode().IsRegular() {
+		return 0, fmt.Errorf("cannot copy %q, of mode %v, for hardlink %q", target, fi.Mode(), p)
+	}
+	src, err := os.Open(target)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+	written, err := io.Copy(dst, src)
+	if err != nil {
+		return 0, err
+	}
+	// Changing the owner drops the setuid and setgid bits, so set the mode
+	// afterwards
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+		if err := dst.Chown(int(st.Uid), int(st.Gid)); err != nil {
+			return 0, err
+		}
+	}
+	if err := dst.Chmod(fi.Mode()); err != nil {
+		return 0, err
+	}
+	return written, dst.Close()
+}
+
+// syncDir fsyncs the directory at p
+func syncDir(p string) error {
+	d, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// entryMode returns the permissions of the entry described by hdr, including
+// the setuid, setgid and sticky bits, which os.FileMode stores apart from the
+// permission bits
+func entryMode(hdr *tar.Header) os.FileMode {
+	mode := os.FileMode(hdr.Mode).Perm()
+	if hdr.Mode&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if hdr.Mode&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if hdr.Mode&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// eofReader is an empty io.Reader
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// isRegular returns whether typ is the type of a regular file. The holes of
+// GNU sparse files are read as zeros, so they are extracted as regular files.
+func isRegular(typ byte) bool {
+	return typ == tar.TypeReg || typ == tar.TypeRegA || typ == tar.TypeGNUSparse
+}
+
+// ctxReader reads from r until ctx is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// supportedType returns whether entries of type typ can be extracted. It must
+// be kept in sync with extractFile.
+func supportedType(typ byte) bool {
+	switch typ {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse, tar.TypeDir, tar.TypeLink, tar.TypeSymlink,
+		tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return true
+	}
+	return false
+}
+
+// handles returns whether entries of type typ are extracted natively by x
+func (x *extraction) handles(typ byte) bool {
+	switch typ {
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if _, ok := x.filesystem().(nodeFS); !ok {
+			return false
+		}
+		return typ == tar.TypeFifo || os.Geteuid() == 0
+	}
+	return supportedType(typ)
+}
+
+// checkName returns an error wrapping ErrInvalidName if the name of the entry
+// described by hdr is empty or absolute, or is "." once cleaned for anything
+// but a directory. A "." directory, as archived by "tar -C dir .", describes
+// the destination directory itself.
+func checkName(hdr *tar.Header) error {
+	name := path.Clean(hdr.Name)
+	switch {
+	case hdr.Name == "":
+		return fmt.Errorf("%w: empty name", ErrInvalidName)
+	case strings.HasPrefix(name, "/"):
+		return fmt.Errorf("%w %q: absolute path", ErrInvalidName, hdr.Name)
+	case name == "." && hdr.Typeflag != tar.TypeDir:
+		return fmt.Errorf("%w %q: refers to the destination directory", ErrInvalidName, hdr.Name)
+	}
+	return nil
+}
+
+// checkEntry returns an error if the entry described by hdr, once relocated,
+// is unsafe or malformed whatever was extracted before it. ValidateTar reports
+// the same errors.
+func checkEntry(hdr *tar.Header, opts ExtractTarOptions) error {
+	// archive/tar resolves these into the header of the next entry, so
+	// seeing one means the stream is malformed or the reader is too old
+	if hdr.Typeflag == tar.TypeGNULongName || hdr.Typeflag == tar.TypeGNULongLink {
+		return fmt.Errorf("unresolved GNU long name header for entry %q", hdr.Name)
+	}
+	if err := checkPath(hdr); err != nil {
+		return err
+	}
+	if err := checkLinkTarget(hdr, opts.maxLinkLength()); err != nil {
+		return err
+	}
+	return checkLink(hdr)
+}
+
+// checkPath returns an error if the entry described by hdr would be extracted
+// outside of the destination directory
+func checkPath(hdr *tar.Header) error {
+	if escapesRoot(hdr.Name) {
+		return fmt.Errorf("%w %q", ErrPathEscape, hdr.Name)
+	}
+	return nil
+}
+
+// checkInside returns an error wrapping ErrPathEscape if p, once cleaned, is
+// not dir or a path below it. checkPath and checkLink already reject the
+// entries this catches; it guards the joined path itself.
+func checkInside(dir, p string) error {
+	// Relative paths are made absolute against the same working directory
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	absP, err := filepath.Abs(p)
+	if err != nil {
+		return err
+	}
+	sep := string(os.PathSeparator)
+	if !strings.HasPrefix(absP+sep, strings.TrimSuffix(absDir, sep)+sep) {
+		return fmt.Errorf("%w: %q is outside of %q", ErrPathEscape, p, dir)
+	}
 	return nil
 }
 
+// checkLinkTarget returns an error if the entry described by hdr is a symlink
+// whose target contains a NUL byte or is longer than max bytes
+func checkLinkTarget(hdr *tar.Header, max int) error {
+	if hdr.Typeflag != tar.TypeSymlink {
+		return nil
+	}
+	if strings.IndexByte(hdr.Linkname, 0) >= 0 {
+		return fmt.Errorf("target of symlink %q contains a NUL byte", hdr.Name)
+	}
+	if len(hdr.Linkname) > max {
+		return fmt.Errorf("target of symlink %q is longer than %d bytes", hdr.Name, max)
+	}
+	return nil
+}
+
+// checkLink returns an error wrapping ErrInsecureLink if the entry described
+// by hdr is a link pointing outside of the destination directory. The targets
+// of hardlinks are relative to the destination directory and the ones of
+// symlinks to the directory of the entry; both are cleaned before checking.
+func checkLink(hdr *tar.Header) error {
+	switch hdr.Typeflag {
+	case tar.TypeLink:
+		if escapesRoot(hdr.Linkname) {
+			return fmt.Errorf("%w %q -> %q", ErrInsecureLink, hdr.Name, hdr.Linkname)
+		}
+	case tar.TypeSymlink:
+		if escapesRoot(filepath.Join(filepath.Dir(hdr.Name), hdr.Linkname)) {
+			return fmt.Errorf("%w %q -> %q", ErrInsecureLink, hdr.Name, hdr.Linkname)
+		}
+	}
+	return nil
+}
+
+// checkParents returns an error wrapping ErrInsecureLink if the parent
+// directory of p, or its deepest existing ancestor, resolves to a location
+// outside of dir once symlinks already extracted are followed. This catches
+// entries that would be written through a symlink to a directory.
+func checkParents(dir, p string) error {
+	if filepath.Clean(p) == filepath.Clean(dir) {
+		// The destination directory itself has no parents to check
+		return nil
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if os.IsNotExist(err) {
+		// Nothing was extracted yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for parent := filepath.Dir(p); ; parent = filepath.Dir(parent) {
+		real, err := filepath.EvalSymlinks(parent)
+		if os.IsNotExist(err) && parent != dir {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(realDir, real)
+		if err != nil || escapesRoot(rel) {
+			return fmt.Errorf("%w in path %q: %q resolves to %q", ErrInsecureLink, p, parent, real)
+		}
+		return nil
+	}
+}
+
+// escapesRoot returns whether p, relative to the root of a tarball, refers to
+// a location outside of it. Like filepath.Join, it treats absolute paths as
+// relative to the root.
+func escapesRoot(p string) bool {
+	p = filepath.Clean("./" + p)
+	return p == ".." || strings.HasPrefix(p, "../")
+}
+
+// parentConflict returns an error wrapping ErrPathConflict if one of the
+// parents of p below dir exists and is not a directory
+func parentConflict(dir, p string) error {
+	rel, err := filepath.Rel(dir, filepath.Dir(p))
+	if err != nil || rel == "." {
+		return nil
+	}
+	parent := dir
+	for _, c := range splitPath(rel) {
+		parent = filepath.Join(parent, c)
+		// Symlinks to directories are fine parents
+		fi, err := os.Stat(parent)
+		if err != nil {
+			return nil
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%w: %q is a %s, not a directory", ErrPathConflict, parent, fileTypeName(fi.Mode()))
+		}
+	}
+	return nil
+}
+
+// handleExistingAtomic is like handleExisting, for the regular files written
+// with AtomicFiles: a file existing at p is left for the rename to replace
+func handleExistingAtomic(fs Filesystem, p string, policy OverwritePolicy) error {
+	fi, err := fs.Lstat(p)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	case !fi.IsDir() && policy == OverwriteExisting:
+		return nil
+	}
+	return handleExisting(fs, p, tar.TypeReg, policy)
+}
+
+// handleExisting applies policy to whatever exists at p of fs, where an entry
+// of type typ is about to be extracted, unless both are directories. Only the
+// OS filesystem can remove directories that are not empty.
+func handleExisting(fs Filesystem, p string, typ byte, policy OverwritePolicy) error {
+	fi, err := fs.Lstat(p)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	case fi.IsDir() && typ == tar.TypeDir:
+		return nil
+	}
+	switch policy {
+	case SkipExisting:
+		return errEntrySkipped
+	case ErrorOnExisting:
+		return fmt.Errorf("%q already exists", p)
+	}
+	if ofs, ok := fs.(osFS); ok {
+		return ofs.RemoveAll(p)
+	}
+	return fs.Remove(p)
+}
+
 // ExtractFileFromTar extracts a regular file from the given tar, returning its
-// contents as a byte slice
+// contents as a byte slice. The content of the entries before the file is
+// skipped by seeking when tr reads from an io.Seeker, such as an *os.File, and
+// read and discarded otherwise, so tr should be created on the io.Seeker
+// itself rather than on a wrapper hiding its Seek method.
 func ExtractFileFromTar(tr *tar.Reader, file string) ([]byte, error) {
 	for {
 		hdr, err := tr.Next()
@@ -155,11 +2065,11 @@ func ExtractFileFromTar(tr *tar.Reader, file string) ([]byte, error) {
 			}
 			buf, err := ioutil.ReadAll(tr)
 			if err != nil {
-				return nil, fmt.Errorf("error extracting tarball: %v", err)
+				return nil, fmt.Errorf("error extracting tarball: %w", err)
 			}
 			return buf, nil
 		default:
-			return nil, fmt.Errorf("error extracting tarball: %v", err)
+			return nil, fmt.Errorf("error extracting tarball: %w", err)
 		}
 	}
 }
@@ -16,11 +16,22 @@ package tar
 
 import (
 	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 type testTarEntry struct {
@@ -49,6 +60,43 @@ func newTestTar(entries []*testTarEntry) (string, error) {
 	return t.Name(), nil
 }
 
+func newTestTarBytes(entries []*testTarEntry) ([]byte, error) {
+	testTarPath, err := newTestTar(entries)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(testTarPath)
+	return ioutil.ReadFile(testTarPath)
+}
+
+// newTestTarReader returns a tar.Reader of an in-memory tarball containing the
+// given entries
+func newTestTarReader(t *testing.T, entries []*testTarEntry) *tar.Reader {
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return tar.NewReader(bytes.NewReader(b))
+}
+
+func newTestDir(t *testing.T) string {
+	tmpdir, err := ioutil.TempDir("", "rocket-temp-dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return tmpdir
+}
+
+// extractTestFile extracts the entry described by hdr, with its content read
+// from r, into dir of the OS filesystem, as ExtractTarWithOptions would
+func extractTestFile(r io.Reader, hdr *tar.Header, dir string, opts ExtractTarOptions) (int64, error) {
+	meta, err := opts.metadata(hdr)
+	if err != nil {
+		return 0, err
+	}
+	return extractFile(osFS{}, r, hdr, meta, dir, opts)
+}
+
 func TestExtractTarInsecureSymlink(t *testing.T) {
 	entries := []*testTarEntry{
 		{
@@ -109,6 +157,69 @@ func TestExtractTarInsecureSymlink(t *testing.T) {
 	}
 }
 
+func TestExtractTarInsecureLinks(t *testing.T) {
+	tests := []struct {
+		typ      byte
+		name     string
+		linkname string
+		insecure bool
+	}{
+		{tar.TypeLink, "link", "hello.txt", false},
+		{tar.TypeLink, "deep/link", "a/../hello.txt", false},
+		{tar.TypeLink, "link", "../secret.conf", true},
+		{tar.TypeLink, "link", "a/../../secret.conf", true},
+		{tar.TypeLink, "link", "./a/b/../../../secret.conf", true},
+		{tar.TypeLink, "deep/link", "deep/../../secret.conf", true},
+		// Traverses the "etc" symlink to /etc
+		{tar.TypeLink, "link", "etc/passwd", true},
+		{tar.TypeSymlink, "link", "hello.txt", false},
+		{tar.TypeSymlink, "deep/link", "../hello.txt", false},
+		{tar.TypeSymlink, "deep/link", "a/../../hello.txt", false},
+		{tar.TypeSymlink, "link", "../secret.conf", true},
+		{tar.TypeSymlink, "link", "a/../../secret.conf", true},
+		{tar.TypeSymlink, "deep/link", "../../secret.conf", true},
+		{tar.TypeSymlink, "deep/link", "./../deep/../../secret.conf", true},
+	}
+	for i, tt := range tests {
+		entries := []*testTarEntry{
+			{
+				contents: "hello",
+				header: &tar.Header{
+					Name: "hello.txt",
+					Size: 5,
+				},
+			},
+			{
+				header: &tar.Header{
+					Name:     "etc",
+					Linkname: "/etc",
+					Typeflag: tar.TypeSymlink,
+				},
+			},
+			{
+				header: &tar.Header{
+					Name:     tt.name,
+					Linkname: tt.linkname,
+					Typeflag: tt.typ,
+				},
+			},
+		}
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		err := ExtractTar(newTestTarReader(t, entries), tmpdir, nil)
+		if tt.insecure && !errors.Is(err, ErrInsecureLink) {
+			t.Errorf("#%d: expected ErrInsecureLink for %q -> %q, got: %v", i, tt.name, tt.linkname, err)
+		}
+		var entryErr *EntryError
+		if tt.insecure && (!errors.As(err, &entryErr) || entryErr.Path != tt.name) {
+			t.Errorf("#%d: expected an EntryError for %q, got: %v", i, tt.name, err)
+		}
+		if !tt.insecure && err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
 func TestExtractTarFolders(t *testing.T) {
 	entries := []*testTarEntry{
 		{
@@ -346,3 +457,3839 @@ func TestExtractTarPWL(t *testing.T) {
 		t.Errorf("unexpected number of files found: %d, wanted 1", len(matches))
 	}
 }
+
+func TestExtractTarOverwrite(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "hello",
+			header: &tar.Header{
+				Name: "hello.txt",
+				Size: 5,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "link.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+			},
+		},
+	}
+	overwrites := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "link.txt",
+				Linkname: "hello.txt",
+				Typeflag: tar.TypeSymlink,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder",
+				Size: 3,
+			},
+		},
+	}
+	tests := []struct {
+		policy OverwritePolicy
+		err    bool
+		link   string
+		folder string
+	}{
+		{OverwriteExisting, false, "hello", "bar"},
+		{SkipExisting, false, "foo", ""},
+		{ErrorOnExisting, true, "foo", ""},
+	}
+	for i, tt := range tests {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		if err := ExtractTar(newTestTarReader(t, entries), tmpdir, nil); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		opts := ExtractTarOptions{Overwrite: tt.policy}
+		err := ExtractTarWithOptions(newTestTarReader(t, overwrites), tmpdir, opts)
+		if tt.err && err == nil {
+			t.Errorf("#%d: expected error", i)
+		} else if !tt.err && err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "link.txt"))
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if string(buf) != tt.link {
+			t.Errorf("#%d: unexpected contents, wanted: %s, got: %s", i, tt.link, buf)
+		}
+		fi, err := os.Lstat(filepath.Join(tmpdir, "folder"))
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if tt.folder == "" && !fi.IsDir() {
+			t.Errorf("#%d: expected folder to be left in place", i)
+		}
+		if tt.folder != "" {
+			buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "folder"))
+			if err != nil {
+				t.Errorf("#%d: unexpected error: %v", i, err)
+			}
+			if string(buf) != tt.folder {
+				t.Errorf("#%d: unexpected contents, wanted: %s, got: %s", i, tt.folder, buf)
+			}
+		}
+	}
+}
+
+func TestExtractTarPreserveOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("ownership can only be preserved as root")
+	}
+	entries := []*testTarEntry{
+		{
+			contents: "hello",
+			header: &tar.Header{
+				Name: "hello.txt",
+				Size: 5,
+				Uid:  1000,
+				Gid:  1001,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "link.txt",
+				Linkname: "hello.txt",
+				Typeflag: tar.TypeSymlink,
+				Uid:      1002,
+				Gid:      1003,
+			},
+		},
+	}
+	for _, preserve := range []bool{false, true} {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		opts := ExtractTarOptions{PreserveOwnership: preserve}
+		if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, entry := range entries {
+			fi, err := os.Lstat(filepath.Join(tmpdir, entry.header.Name))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			st := fi.Sys().(*syscall.Stat_t)
+			uid, gid := 0, 0
+			if preserve {
+				uid, gid = entry.header.Uid, entry.header.Gid
+			}
+			if int(st.Uid) != uid || int(st.Gid) != gid {
+				t.Errorf("%s: unexpected owner %d:%d, wanted %d:%d", entry.header.Name, st.Uid, st.Gid, uid, gid)
+			}
+		}
+	}
+}
+
+func TestExtractTarIDMapping(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("ownership can only be preserved as root")
+	}
+	opts := ExtractTarOptions{
+		PreserveOwnership: true,
+		UIDMap:            []IDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDMap:            []IDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}},
+	}
+
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	entries := []*testTarEntry{
+		{
+			contents: "hello",
+			header: &tar.Header{
+				Name: "hello.txt",
+				Size: 5,
+				Uid:  1000,
+				Gid:  1001,
+			},
+		},
+	}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fi, err := os.Lstat(filepath.Join(tmpdir, "hello.txt"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	if st.Uid != 101000 || st.Gid != 201001 {
+		t.Errorf("unexpected owner %d:%d, wanted %d:%d", st.Uid, st.Gid, 101000, 201001)
+	}
+
+	entries[0].header.Uid = 70000
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err == nil {
+		t.Errorf("expected error for unmapped uid")
+	}
+}
+
+func TestExtractTarForceOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("ownership can only be changed as root")
+	}
+	entries := []*testTarEntry{
+		{
+			contents: "hello",
+			header: &tar.Header{
+				Name: "hello.txt",
+				Size: 5,
+				Uid:  1000,
+				Gid:  1001,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "link.txt",
+				Linkname: "hello.txt",
+				Typeflag: tar.TypeSymlink,
+				Uid:      70000,
+				Gid:      1003,
+			},
+		},
+	}
+	uid, gid := 2000, 2001
+	tests := []struct {
+		opts     ExtractTarOptions
+		uid, gid int
+	}{
+		{ExtractTarOptions{ForceUID: &uid, ForceGID: &gid}, uid, gid},
+		{ExtractTarOptions{ForceUID: &uid}, uid, 0},
+		// The forced uid needs no mapping
+		{
+			ExtractTarOptions{
+				ForceUID:          &uid,
+				PreserveOwnership: true,
+				UIDMap:            []IDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+			},
+			uid, -1,
+		},
+	}
+	for i, tt := range tests {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, tt.opts); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		for _, entry := range entries {
+			fi, err := os.Lstat(filepath.Join(tmpdir, entry.header.Name))
+			if err != nil {
+				t.Fatalf("#%d: unexpected error: %v", i, err)
+			}
+			st := fi.Sys().(*syscall.Stat_t)
+			gid := tt.gid
+			if gid == -1 {
+				gid = entry.header.Gid
+			}
+			if int(st.Uid) != tt.uid || int(st.Gid) != gid {
+				t.Errorf("#%d: %s: unexpected owner %d:%d, wanted %d:%d", i, entry.header.Name, st.Uid, st.Gid, tt.uid, gid)
+			}
+		}
+	}
+}
+
+func TestExtractTarDevices(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("device nodes can only be created as root")
+	}
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "dev/null",
+				Typeflag: tar.TypeChar,
+				Mode:     int64(0666),
+				Devmajor: 1,
+				Devminor: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "dev/loop0",
+				Typeflag: tar.TypeBlock,
+				Mode:     int64(0660),
+				Devmajor: 7,
+				Devminor: 0,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTar(newTestTarReader(t, entries), tmpdir, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, entry := range entries {
+		fi, err := os.Lstat(filepath.Join(tmpdir, entry.header.Name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		wantType := os.ModeDevice | os.ModeCharDevice
+		if entry.header.Typeflag == tar.TypeBlock {
+			wantType = os.ModeDevice
+		}
+		if fi.Mode()&os.ModeType != wantType {
+			t.Errorf("%s: unexpected file type: %v", entry.header.Name, fi.Mode())
+		}
+		if fi.Mode().Perm() != os.FileMode(entry.header.Mode) {
+			t.Errorf("%s: unexpected mode: %v", entry.header.Name, fi.Mode())
+		}
+		rdev := fi.Sys().(*syscall.Stat_t).Rdev
+		if want := makedev(int(entry.header.Devmajor), int(entry.header.Devminor)); rdev != uint64(want) {
+			t.Errorf("%s: unexpected rdev %#x, wanted %#x", entry.header.Name, rdev, want)
+		}
+	}
+}
+
+func TestExtractTarFifo(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/fifo",
+				Typeflag: tar.TypeFifo,
+				Mode:     int64(0640),
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTar(newTestTarReader(t, entries), tmpdir, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fi, err := os.Lstat(filepath.Join(tmpdir, "folder/fifo"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("unexpected file type: %v", fi.Mode())
+	}
+	if fi.Mode().Perm() != os.FileMode(0640) {
+		t.Errorf("unexpected mode: %v", fi.Mode())
+	}
+}
+
+func TestExtractTarOnEntry(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0747),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink.txt",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+
+	var (
+		names   []string
+		written []int64
+	)
+	opts := ExtractTarOptions{
+		OnEntry: func(hdr *tar.Header, n int64) {
+			names = append(names, hdr.Name)
+			written = append(written, n)
+		},
+	}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(names) != len(entries) {
+		t.Fatalf("unexpected number of callbacks: %d, wanted %d", len(names), len(entries))
+	}
+	for i, entry := range entries {
+		if names[i] != entry.header.Name {
+			t.Errorf("unexpected entry name %q, wanted %q", names[i], entry.header.Name)
+		}
+		if written[i] != entry.header.Size {
+			t.Errorf("%s: unexpected bytes written %d, wanted %d", entry.header.Name, written[i], entry.header.Size)
+		}
+	}
+}
+
+func TestExtractTarContext(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := ExtractTarOptions{
+		OnEntry: func(hdr *tar.Header, n int64) {
+			cancel()
+		},
+	}
+	err := ExtractTarContext(ctx, newTestTarReader(t, entries), tmpdir, opts)
+	if err != context.Canceled {
+		t.Errorf("unexpected error: %v, wanted %v", err, context.Canceled)
+	}
+	if _, err := os.Lstat(filepath.Join(tmpdir, "foo.txt")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tmpdir, "bar.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected bar.txt not to be extracted")
+	}
+}
+
+func TestExtractTarLimits(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0747),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/hardlink",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder/foo.txt",
+			},
+		},
+	}
+	tests := []struct {
+		opts ExtractTarOptions
+		err  error
+	}{
+		{ExtractTarOptions{MaxTotalBytes: 6, MaxEntries: 5, MaxLinks: 2}, nil},
+		{ExtractTarOptions{MaxTotalBytes: 5}, ErrSizeLimitExceeded},
+		{ExtractTarOptions{MaxEntries: 2}, ErrTooManyEntries},
+		{ExtractTarOptions{MaxLinks: 1}, ErrTooManyLinks},
+	}
+	for i, tt := range tests {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, tt.opts)
+		if err != tt.err {
+			t.Errorf("#%d: unexpected error: %v, wanted %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestExtractTarShortContent(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foobarbaz!",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 10,
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The content ends before the size declared in the header
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	err = ExtractTarWithOptions(tar.NewReader(bytes.NewReader(b[:512+3])), tmpdir, ExtractTarOptions{})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected io.ErrUnexpectedEOF, got: %v", err)
+	}
+}
+
+func TestExtractTarManifest(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0747),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 3,
+				Mode: int64(0600),
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+
+	pwl := make(PathWhitelistMap)
+	pwl["folder"] = struct{}{}
+	pwl["folder/foo.txt"] = struct{}{}
+	opts := ExtractTarOptions{Whitelist: pwl}
+	manifest, err := ExtractTarManifest(newTestTarReader(t, entries), tmpdir, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []ExtractedEntry{
+		{filepath.Join(tmpdir, "folder"), tar.TypeDir, 0, os.ModeDir | 0747, false},
+		{filepath.Join(tmpdir, "folder/foo.txt"), tar.TypeReg, 3, 0644, false},
+		{filepath.Join(tmpdir, "folder/bar.txt"), tar.TypeReg, 3, 0600, true},
+	}
+	if len(manifest) != len(want) {
+		t.Fatalf("unexpected number of entries: %d, wanted %d", len(manifest), len(want))
+	}
+	for i := range want {
+		if manifest[i] != want[i] {
+			t.Errorf("unexpected entry %+v, wanted %+v", manifest[i], want[i])
+		}
+	}
+}
+
+func TestExtractTarStripComponents(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "package-1.2.3/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "package-1.2.3/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "package-1.2.3/folder/bar.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "package-1.2.3/link.txt",
+				Typeflag: tar.TypeLink,
+				Linkname: "package-1.2.3/foo.txt",
+			},
+		},
+		{
+			contents: "baz",
+			header: &tar.Header{
+				Name: "baz.txt",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{StripComponents: 1}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"foo.txt", "folder/bar.txt", "link.txt"} {
+		if _, err := os.Lstat(filepath.Join(tmpdir, name)); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	for _, name := range []string{"package-1.2.3", "baz.txt"} {
+		if _, err := os.Lstat(filepath.Join(tmpdir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to be extracted", name)
+		}
+	}
+}
+
+func TestExtractTarRename(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "rootfs/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "{}",
+			header: &tar.Header{
+				Name: "manifest",
+				Size: 2,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "rootfs/link.txt",
+				Linkname: "../secret.txt",
+				Typeflag: tar.TypeSymlink,
+			},
+		},
+	}
+	rename := func(name string) (string, bool) {
+		if name == "manifest" {
+			return "", false
+		}
+		return strings.TrimPrefix(name, "rootfs/"), true
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{Rename: rename}
+	err := ExtractTarWithOptions(newTestTarReader(t, entries[:2]), tmpdir, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tmpdir, "foo.txt")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tmpdir, "manifest")); !os.IsNotExist(err) {
+		t.Errorf("expected manifest not to be extracted")
+	}
+
+	// The link is checked against its renamed location
+	err = ExtractTarWithOptions(newTestTarReader(t, entries[2:]), tmpdir, opts)
+	if err == nil {
+		t.Errorf("expected error")
+	}
+
+	opts.Rename = func(name string) (string, bool) {
+		return "/" + name, true
+	}
+	err = ExtractTarWithOptions(newTestTarReader(t, entries[:1]), tmpdir, opts)
+	if err == nil {
+		t.Errorf("expected error for absolute path")
+	}
+}
+
+func TestExtractTarGlobWhitelist(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder/bar.bin",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{Whitelist: GlobWhitelist{"folder/*.txt"}}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	matches, err := filepath.Glob(filepath.Join(tmpdir, "folder/*"))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(matches) != 1 {
+		t.Errorf("unexpected number of files found: %d, wanted 1", len(matches))
+	}
+}
+
+func TestExtractTarPWLParentDirs(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "deep/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0700),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "deep/folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0700),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "deep/folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "other/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "symlink.txt",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "deep/folder/foo.txt",
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+
+	pwl := make(PathWhitelistMap)
+	pwl["deep/folder/foo.txt"] = struct{}{}
+	if err := ExtractTar(newTestTarReader(t, entries), tmpdir, pwl); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tmpdir, "deep/folder/foo.txt")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"deep", "deep/folder"} {
+		dirInfo, err := os.Lstat(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else if dirInfo.Mode().Perm() != DEFAULT_DIR_MODE {
+			t.Errorf("%s: unexpected dir mode: %s", name, dirInfo.Mode())
+		}
+	}
+	for _, name := range []string{"other", "symlink.txt"} {
+		if _, err := os.Lstat(filepath.Join(tmpdir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to be extracted", name)
+		}
+	}
+}
+
+func TestExtractTarDeferredHardlinks(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "link2.txt",
+				Typeflag: tar.TypeLink,
+				Linkname: "link.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "link.txt",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder/foo.txt",
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTar(newTestTarReader(t, entries), tmpdir, nil); err == nil {
+		t.Errorf("expected error")
+	}
+
+	tmpdir2 := newTestDir(t)
+	defer os.RemoveAll(tmpdir2)
+	opts := ExtractTarOptions{DeferredHardlinks: true}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir2, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"link.txt", "link2.txt"} {
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir2, name))
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if string(buf) != "foo" {
+			t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+		}
+	}
+
+	tmpdir3 := newTestDir(t)
+	defer os.RemoveAll(tmpdir3)
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries[:2]), tmpdir3, opts); err == nil {
+		t.Errorf("expected error for missing hardlink target")
+	}
+}
+
+func TestExtractTarDetectDuplicates(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "{}",
+			header: &tar.Header{
+				Name: "config.json",
+				Size: 2,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "./config.json",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "other.json",
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTar(newTestTarReader(t, entries), tmpdir, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	opts := ExtractTarOptions{DetectDuplicates: true}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestExtractTarSymlinkedParent(t *testing.T) {
+	outside := newTestDir(t)
+	defer os.RemoveAll(outside)
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "data",
+				Typeflag: tar.TypeSymlink,
+				Linkname: outside,
+			},
+		},
+		{
+			contents: "secret",
+			header: &tar.Header{
+				Name: "data/deep/passwd",
+				Size: 6,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTar(newTestTarReader(t, entries), tmpdir, nil); err == nil {
+		t.Errorf("expected error")
+	}
+	if infos, err := ioutil.ReadDir(outside); err != nil || len(infos) != 0 {
+		t.Errorf("unexpected files written outside: %v (err: %v)", infos, err)
+	}
+
+	// Symlinks to directories inside are fine
+	entries = []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "data",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "folder",
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "data/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir2 := newTestDir(t)
+	defer os.RemoveAll(tmpdir2)
+	if err := ExtractTar(newTestTarReader(t, entries), tmpdir2, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tmpdir2, "folder/foo.txt")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractTarSpecialModeBits(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "#!/bin/sh",
+			header: &tar.Header{
+				Name: "bin/setuid",
+				Size: 9,
+				Mode: int64(04755),
+				Uid:  1000,
+			},
+		},
+		{
+			contents: "#!/bin/sh",
+			header: &tar.Header{
+				Name: "bin/setgid",
+				Size: 9,
+				Mode: int64(02755),
+				Gid:  1000,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "tmp/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(01777),
+			},
+		},
+	}
+	want := []os.FileMode{
+		os.ModeSetuid | 0755,
+		os.ModeSetgid | 0755,
+		os.ModeDir | os.ModeSticky | 0777,
+	}
+	for _, preserve := range []bool{false, true} {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		opts := ExtractTarOptions{PreserveOwnership: preserve}
+		if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for i, entry := range entries {
+			fi, err := os.Lstat(filepath.Join(tmpdir, entry.header.Name))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fi.Mode() != want[i] {
+				t.Errorf("%s: unexpected mode %v, wanted %v", entry.header.Name, fi.Mode(), want[i])
+			}
+		}
+	}
+}
+
+func TestExtractTarUmask(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "implicit/foo.txt",
+				Size: 3,
+				Mode: int64(0666),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0777),
+			},
+		},
+		{
+			contents: "#!/bin/sh",
+			header: &tar.Header{
+				Name: "folder/setuid",
+				Size: 9,
+				Mode: int64(04777),
+			},
+		},
+	}
+	want := map[string]os.FileMode{
+		"implicit":         os.ModeDir | 0755,
+		"implicit/foo.txt": 0644,
+		"folder":           os.ModeDir | 0755,
+		"folder/setuid":    os.ModeSetuid | 0755,
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	umask := os.FileMode(0022)
+	opts := ExtractTarOptions{Umask: &umask}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, mode := range want {
+		fi, err := os.Lstat(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fi.Mode() != mode {
+			t.Errorf("%s: unexpected mode %v, wanted %v", name, fi.Mode(), mode)
+		}
+	}
+}
+
+func TestExtractTarGNULongName(t *testing.T) {
+	long := strings.Repeat("d/", 60) + "foo.txt"
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:   long,
+				Size:   3,
+				Format: tar.FormatGNU,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     strings.Repeat("l", 120),
+				Linkname: long,
+				Typeflag: tar.TypeLink,
+				Format:   tar.FormatGNU,
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Contains(b, []byte("././@LongLink")) {
+		t.Fatalf("expected GNU long name records in the test tarball")
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTar(tar.NewReader(bytes.NewReader(b)), tmpdir, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{long, strings.Repeat("l", 120)} {
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf) != "foo" {
+			t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+		}
+	}
+
+	// Should one reach the extraction, it must not become a file
+	hdr := &tar.Header{
+		Name:     "././@LongLink",
+		Typeflag: tar.TypeGNULongName,
+		Size:     0,
+	}
+	_, err = extractTestFile(strings.NewReader(""), hdr, tmpdir, ExtractTarOptions{})
+	if err == nil || !strings.Contains(err.Error(), "@LongLink") {
+		t.Errorf("expected an error naming the entry, got: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tmpdir, "././@LongLink")); !os.IsNotExist(err) {
+		t.Errorf("expected no file to be created, got: %v", err)
+	}
+}
+
+func TestExtractTarFileHashes(t *testing.T) {
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "./folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	tests := []struct {
+		hashes map[string]string
+		strict bool
+		err    string
+	}{
+		{
+			hashes: map[string]string{"folder/foo.txt": sum("foo")},
+		},
+		{
+			hashes: map[string]string{"folder/foo.txt": strings.ToUpper(sum("foo")), "folder/bar.txt": sum("bar")},
+			strict: true,
+		},
+		{
+			hashes: map[string]string{"folder/foo.txt": sum("foo")},
+			strict: true,
+			err:    "no hash",
+		},
+		{
+			hashes: map[string]string{"folder/bar.txt": sum("foo")},
+			err:    "hash mismatch",
+		},
+	}
+	for i, tt := range tests {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		opts := ExtractTarOptions{FileHashes: tt.hashes, StrictHashes: tt.strict}
+		err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("#%d: unexpected error: %v", i, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("#%d: expected error containing %q, got: %v", i, tt.err, err)
+		}
+		if _, err := os.Lstat(filepath.Join(tmpdir, "folder/bar.txt")); !os.IsNotExist(err) {
+			t.Errorf("#%d: expected folder/bar.txt not to exist, got: %v", i, err)
+		}
+	}
+}
+
+func TestExtractTarStats(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0747),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "barbaz",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 6,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder/foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+		{
+			contents: "skipped",
+			header: &tar.Header{
+				Name: "skipped.txt",
+				Size: 7,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	var stats ExtractStats
+	opts := ExtractTarOptions{
+		Whitelist: GlobWhitelist{"folder", "folder/**"},
+		Stats:     &stats,
+	}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := ExtractStats{
+		TotalBytes:   9,
+		FileCount:    3,
+		DirCount:     1,
+		SymlinkCount: 1,
+		SkippedCount: 1,
+	}
+	if stats != want {
+		t.Errorf("unexpected stats %+v, wanted %+v", stats, want)
+	}
+}
+
+func TestExtractTarExclude(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "rootfs/dev/",
+				Typeflag: tar.TypeDir,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "rootfs/dev/escape",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "../../../../etc",
+			},
+		},
+		{
+			contents: "1",
+			header: &tar.Header{
+				Name: "rootfs/proc/1/status",
+				Size: 1,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "rootfs/etc/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{
+		StripComponents: 1,
+		Exclude:         []string{"dev", "proc"},
+	}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"dev", "proc"} {
+		if _, err := os.Lstat(filepath.Join(tmpdir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to exist, got: %v", name, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(tmpdir, "etc/foo.txt")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractTarDirModeOrder(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "locked/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0500),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "locked/sub/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0700),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "locked/sub/foo.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "after/deep/bar.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "after/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0750),
+			},
+		},
+	}
+	want := map[string]os.FileMode{
+		"locked":             os.ModeDir | 0500,
+		"locked/sub":         os.ModeDir | 0700,
+		"locked/sub/foo.txt": 0644,
+		"after":              os.ModeDir | 0750,
+		"after/deep":         os.ModeDir | DEFAULT_DIR_MODE,
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTar(newTestTarReader(t, entries), tmpdir, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, mode := range want {
+		fi, err := os.Lstat(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fi.Mode() != mode {
+			t.Errorf("%s: unexpected mode %v, wanted %v", name, fi.Mode(), mode)
+		}
+	}
+}
+
+func TestExtractTarDestPrefix(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder/foo.txt",
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{DestPrefix: "./rootfs/"}
+	manifest, err := ExtractTarManifest(newTestTarReader(t, entries), tmpdir, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{
+		filepath.Join(tmpdir, "rootfs/folder/foo.txt"),
+		filepath.Join(tmpdir, "rootfs/folder/link"),
+	}
+	if len(manifest) != len(want) {
+		t.Fatalf("unexpected number of entries: %d, wanted %d", len(manifest), len(want))
+	}
+	for i, p := range want {
+		if manifest[i].Path != p {
+			t.Errorf("unexpected path %q, wanted %q", manifest[i].Path, p)
+		}
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf) != "foo" {
+			t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+		}
+	}
+
+	for _, prefix := range []string{"..", "rootfs/../..", "a/../b", "/rootfs"} {
+		opts := ExtractTarOptions{DestPrefix: prefix}
+		if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err == nil {
+			t.Errorf("expected error for prefix %q", prefix)
+		}
+	}
+}
+
+func TestExtractTarOnWarn(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "dev/null",
+				Typeflag: tar.TypeChar,
+				Mode:     int64(0666),
+				Devmajor: 1,
+				Devminor: 3,
+			},
+		},
+	}
+	var warned []string
+	onWarn := func(path string, err error) {
+		warned = append(warned, path)
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+
+	// Normal entries raise no warnings
+	opts := ExtractTarOptions{OnWarn: onWarn}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries[:1]), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(warned) != 0 {
+		t.Errorf("unexpected warnings for %v", warned)
+	}
+
+	// Device nodes and owners need root, so drop it as long as extracting
+	if os.Geteuid() == 0 {
+		if err := os.Chmod(tmpdir, 0777); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := syscall.Setreuid(-1, 65534); err != nil {
+			t.Skipf("unable to drop root: %v", err)
+		}
+	}
+	opts = ExtractTarOptions{
+		OnWarn:            onWarn,
+		SkipDevices:       true,
+		PreserveOwnership: true,
+	}
+	err := ExtractTarWithOptions(newTestTarReader(t, entries), filepath.Join(tmpdir, "unprivileged"), opts)
+	if os.Getuid() == 0 {
+		if err := syscall.Setreuid(-1, 0); err != nil {
+			t.Fatalf("unable to restore root: %v", err)
+		}
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{
+		filepath.Join(tmpdir, "unprivileged/folder/foo.txt"),
+		filepath.Join(tmpdir, "unprivileged/dev/null"),
+	}
+	if strings.Join(warned, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected warnings for %v, wanted %v", warned, want)
+	}
+}
+
+func TestExtractTarRebaseAbsoluteLinks(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "#!/bin/sh",
+			header: &tar.Header{
+				Name: "usr/bin/python3",
+				Size: 9,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "usr/bin/python",
+				Linkname: "/usr/bin/python3",
+				Typeflag: tar.TypeSymlink,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "usr/local/bin/python",
+				Linkname: "/usr/bin/../bin/python3",
+				Typeflag: tar.TypeSymlink,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "python",
+				Linkname: "/usr/bin/python3",
+				Typeflag: tar.TypeSymlink,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "relative",
+				Linkname: "usr/bin/python3",
+				Typeflag: tar.TypeSymlink,
+			},
+		},
+	}
+	want := map[string]string{
+		"usr/bin/python":       "python3",
+		"usr/local/bin/python": "../../bin/python3",
+		"python":               "usr/bin/python3",
+		"relative":             "usr/bin/python3",
+	}
+	for _, rebase := range []bool{false, true} {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		opts := ExtractTarOptions{RebaseAbsoluteLinks: rebase}
+		if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, entry := range entries[1:] {
+			name := entry.header.Name
+			target, err := os.Readlink(filepath.Join(tmpdir, name))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			wantTarget := entry.header.Linkname
+			if rebase {
+				wantTarget = want[name]
+			}
+			if target != wantTarget {
+				t.Errorf("%s: unexpected target %q, wanted %q", name, target, wantTarget)
+			}
+			if !rebase {
+				continue
+			}
+			buf, err := ioutil.ReadFile(filepath.Join(tmpdir, name))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(buf) != "#!/bin/sh" {
+				t.Errorf("%s: unexpected contents %q", name, buf)
+			}
+		}
+	}
+}
+
+func TestExtractTarReader(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTarReader(bytes.NewReader(b), tmpdir, ExtractTarOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "folder/foo.txt"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != "foo" {
+		t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+	}
+	if err := ExtractTarReader(bytes.NewReader(b[:514]), tmpdir, ExtractTarOptions{}); err == nil {
+		t.Errorf("expected error for truncated tarball")
+	}
+}
+
+func TestExtractTarSync(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+	}
+	for _, policy := range []SyncPolicy{SyncNone, SyncFiles, SyncDir} {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		opts := ExtractTarOptions{Sync: policy}
+		if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+			t.Fatalf("policy %d: unexpected error: %v", policy, err)
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "folder/symlink"))
+		if err != nil {
+			t.Fatalf("policy %d: unexpected error: %v", policy, err)
+		}
+		if string(buf) != "foo" {
+			t.Errorf("policy %d: unexpected contents, wanted: %s, got: %s", policy, "foo", buf)
+		}
+	}
+}
+
+// newSmallFilesTar returns a tarball of n files of size bytes each
+func newSmallFilesTar(b *testing.B, n, size int) []byte {
+	var entries []*testTarEntry
+	for i := 0; i < n; i++ {
+		entries = append(entries, &testTarEntry{
+			contents: strings.Repeat("x", size),
+			header: &tar.Header{
+				Name: fmt.Sprintf("folder%d/file%d", i%16, i),
+				Size: int64(size),
+			},
+		})
+	}
+	buf, err := newTestTarBytes(entries)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	return buf
+}
+
+func BenchmarkExtractTarSmallFiles(b *testing.B) {
+	buf := newSmallFilesTar(b, 1000, 100)
+	for _, size := range []int{16, DefaultWriteBufferSize} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			opts := ExtractTarOptions{WriteBufferSize: size}
+			for i := 0; i < b.N; i++ {
+				tmpdir, err := ioutil.TempDir("", "rocket-temp-dir")
+				if err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+				if err := ExtractTarReader(bytes.NewReader(buf), tmpdir, opts); err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+				os.RemoveAll(tmpdir)
+			}
+		})
+	}
+}
+
+func TestExtractTarParallel(t *testing.T) {
+	var entries []*testTarEntry
+	for i := 0; i < 50; i++ {
+		entries = append(entries, &testTarEntry{
+			contents: fmt.Sprintf("file%d", i),
+			header: &tar.Header{
+				Name: fmt.Sprintf("folder%d/file%d", i%4, i),
+				Size: int64(len(fmt.Sprintf("file%d", i))),
+				Mode: int64(0644),
+			},
+		})
+	}
+	entries = append(entries,
+		// Replaces a file pending to be written
+		&testTarEntry{
+			contents: "replaced",
+			header: &tar.Header{
+				Name: "folder0/file0",
+				Size: 8,
+				Mode: int64(0600),
+			},
+		},
+		&testTarEntry{
+			header: &tar.Header{
+				Name:     "folder1/link",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder1/file1",
+			},
+		},
+		&testTarEntry{
+			header: &tar.Header{
+				Name:     "folder2/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0700),
+			},
+		},
+		&testTarEntry{
+			contents: strings.Repeat("x", ParallelMaxFileSize+1),
+			header: &tar.Header{
+				Name: "folder3/big",
+				Size: ParallelMaxFileSize + 1,
+			},
+		},
+	)
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	var stats ExtractStats
+	opts := ExtractTarOptions{Parallelism: 4, Stats: &stats}
+	manifest, err := ExtractTarManifest(newTestTarReader(t, entries), tmpdir, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(manifest) != len(entries) {
+		t.Errorf("unexpected number of entries: %d, wanted %d", len(manifest), len(entries))
+	}
+	if stats.FileCount != len(entries)-1 || stats.DirCount != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	want := map[string]string{
+		"folder0/file0": "replaced",
+		"folder1/link":  "file1",
+		"folder2/file2": "file2",
+		"folder3/file7": "file7",
+	}
+	for name, contents := range want {
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf) != contents {
+			t.Errorf("%s: unexpected contents, wanted: %s, got: %s", name, contents, buf)
+		}
+	}
+
+	// Files sharing parents missing from the destination
+	var shared []*testTarEntry
+	for i := 0; i < 16; i++ {
+		shared = append(shared, &testTarEntry{
+			contents: "foo",
+			header: &tar.Header{
+				Name: fmt.Sprintf("folder%d/sub/file%d", i%2, i),
+				Size: 3,
+				Mode: int64(0644),
+			},
+		})
+	}
+	for i := 0; i < 50; i++ {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		opts := ExtractTarOptions{Parallelism: 8}
+		if err := ExtractTarWithOptions(newTestTarReader(t, shared), tmpdir, opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// Errors of the workers stop the extraction
+	entries[10].header.Name = "../escape"
+	tmpdir2 := newTestDir(t)
+	defer os.RemoveAll(tmpdir2)
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir2, opts); err == nil {
+		t.Errorf("expected error for insecure path")
+	}
+}
+
+func BenchmarkExtractTarParallel(b *testing.B) {
+	buf := newSmallFilesTar(b, 200, 64*1024)
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("parallelism=%d", n), func(b *testing.B) {
+			opts := ExtractTarOptions{Parallelism: n}
+			for i := 0; i < b.N; i++ {
+				tmpdir, err := ioutil.TempDir("", "rocket-temp-dir")
+				if err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+				if err := ExtractTarReader(bytes.NewReader(buf), tmpdir, opts); err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+				os.RemoveAll(tmpdir)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolMissingParents(t *testing.T) {
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "x/y/1",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+	}
+	tr := newTestTarReader(t, entries)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	x := &extraction{ctx: context.Background(), dir: tmpdir}
+	wp := newWorkerPool(2)
+	defer wp.close()
+	if err := wp.extract(x, tr, hdr, hdr); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Files needing the parents the pending one creates wait for it
+	for name, want := range map[string]bool{"x/y/2": true, "x/z": true, "w/1": false} {
+		if got := wp.conflicts(name); got != want {
+			t.Errorf("%s: unexpected conflict %v, wanted %v", name, got, want)
+		}
+	}
+	if err := wp.wait(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if wp.conflicts("x/y/2") {
+		t.Errorf("unexpected conflict once the parents exist")
+	}
+}
+
+func TestExtractTarErrors(t *testing.T) {
+	tests := []struct {
+		header *tar.Header
+		err    error
+	}{
+		{
+			&tar.Header{Name: "../escape", Typeflag: tar.TypeDir},
+			ErrPathEscape,
+		},
+		{
+			&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../escape"},
+			ErrInsecureLink,
+		},
+		{
+			&tar.Header{Name: "socket", Typeflag: 'X'},
+			ErrUnsupportedType,
+		},
+	}
+	for i, tt := range tests {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		entries := []*testTarEntry{{header: tt.header}}
+		err := ExtractTar(newTestTarReader(t, entries), tmpdir, nil)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("#%d: expected %v, got: %v", i, tt.err, err)
+		}
+		var entryErr *EntryError
+		if !errors.As(err, &entryErr) || entryErr.Path != tt.header.Name {
+			t.Errorf("#%d: expected an EntryError for %q, got: %v", i, tt.header.Name, err)
+		}
+		hdr := *tt.header
+		if err := ExtractFile(tar.NewReader(strings.NewReader("")), &hdr, tmpdir); !errors.Is(err, tt.err) {
+			t.Errorf("#%d: ExtractFile: expected %v, got: %v", i, tt.err, err)
+		}
+	}
+}
+
+func TestExtractTarContinueOnError(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "../../escape",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/socket",
+				Typeflag: 'X',
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTar(newTestTarReader(t, entries), tmpdir, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := os.Lstat(filepath.Join(tmpdir, "folder/bar.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected folder/bar.txt not to exist, got: %v", err)
+	}
+
+	opts := ExtractTarOptions{ContinueOnError: true}
+	err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts)
+	var errs EntryErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected EntryErrors, got: %v", err)
+	}
+	if len(errs) != 2 || errs[0].Path != "folder/link" || errs[1].Path != "folder/socket" {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if !errors.Is(err, ErrInsecureLink) || !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("expected the causes to be wrapped, got: %v", err)
+	}
+	for _, name := range []string{"folder/foo.txt", "folder/bar.txt"} {
+		if _, err := os.Lstat(filepath.Join(tmpdir, name)); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestExtractTarSkeletonOnly(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "proc/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0555),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "etc/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "var/lib/app/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0700),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "var/link",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "lib",
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{SkeletonOnly: true}
+	manifest, err := ExtractTarManifest(newTestTarReader(t, entries), tmpdir, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var dirs []string
+	for _, e := range manifest {
+		if !e.Skipped {
+			dirs = append(dirs, e.Path)
+		}
+	}
+	wantDirs := []string{filepath.Join(tmpdir, "proc"), filepath.Join(tmpdir, "var/lib/app")}
+	if strings.Join(dirs, ",") != strings.Join(wantDirs, ",") {
+		t.Errorf("unexpected directories %v, wanted %v", dirs, wantDirs)
+	}
+	want := map[string]os.FileMode{
+		"proc":        os.ModeDir | 0555,
+		"var":         os.ModeDir | DEFAULT_DIR_MODE,
+		"var/lib/app": os.ModeDir | 0700,
+	}
+	for name, mode := range want {
+		fi, err := os.Lstat(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fi.Mode() != mode {
+			t.Errorf("%s: unexpected mode %v, wanted %v", name, fi.Mode(), mode)
+		}
+	}
+	for _, name := range []string{"etc", "var/link"} {
+		if _, err := os.Lstat(filepath.Join(tmpdir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to exist, got: %v", name, err)
+		}
+	}
+}
+
+func TestExtractTarPAXPath(t *testing.T) {
+	// Too long for the ustar name field, even with the prefix field
+	long := "folder/" + strings.Repeat("long-file-name-", 8) + "foo.txt"
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:   long,
+				Size:   3,
+				Format: tar.FormatPAX,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "link",
+				Linkname: long,
+				Typeflag: tar.TypeSymlink,
+				Format:   tar.FormatPAX,
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Contains(b, []byte(" path="+long)) || !bytes.Contains(b, []byte(" linkpath="+long)) {
+		t.Fatalf("expected PAX path records in the test tarball")
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTar(tar.NewReader(bytes.NewReader(b)), tmpdir, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{long, "link"} {
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf) != "foo" {
+			t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+		}
+	}
+}
+
+func TestExtractTarApplyWhiteouts(t *testing.T) {
+	lower := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "etc/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "etc/bar.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "old",
+			header: &tar.Header{
+				Name: "opaque/old.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "old",
+			header: &tar.Header{
+				Name: "opaque/sub/old.txt",
+				Size: 3,
+			},
+		},
+	}
+	upper := []*testTarEntry{
+		{
+			contents: "new",
+			header: &tar.Header{
+				Name: "opaque/sub/new.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name: "etc/.wh.foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name: "opaque/.wh..wh..opq",
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTar(newTestTarReader(t, lower), tmpdir, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	opts := ExtractTarOptions{ApplyWhiteouts: true}
+	if err := ExtractTarWithOptions(newTestTarReader(t, upper), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"etc/bar.txt", "opaque/sub/new.txt"} {
+		if _, err := os.Lstat(filepath.Join(tmpdir, name)); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	for _, name := range []string{"etc/foo.txt", "etc/.wh.foo.txt", "opaque/old.txt", "opaque/sub/old.txt", "opaque/.wh..wh..opq"} {
+		if _, err := os.Lstat(filepath.Join(tmpdir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to exist, got: %v", name, err)
+		}
+	}
+
+	// Without the option whiteouts are plain files
+	if err := ExtractTar(newTestTarReader(t, upper), tmpdir, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tmpdir, "etc/.wh.foo.txt")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Whiteouts cannot remove through symlinks
+	outside := newTestDir(t)
+	defer os.RemoveAll(outside)
+	if err := ioutil.WriteFile(filepath.Join(outside, "passwd"), []byte("x"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(tmpdir, "link")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	evil := []*testTarEntry{{header: &tar.Header{Name: "link/.wh.passwd"}}}
+	if err := ExtractTarWithOptions(newTestTarReader(t, evil), tmpdir, opts); !errors.Is(err, ErrInsecureLink) {
+		t.Errorf("expected ErrInsecureLink, got: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "passwd")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractTarFlattenHardlinks(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: int64(04755),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder/foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "/etc/passwd",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link-to-symlink",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder/symlink",
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	var stats ExtractStats
+	opts := ExtractTarOptions{FlattenHardlinks: true, Stats: &stats}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	target, err := os.Stat(filepath.Join(tmpdir, "folder/foo.txt"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	link, err := os.Stat(filepath.Join(tmpdir, "folder/link"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if os.SameFile(target, link) {
+		t.Errorf("expected an independent copy")
+	}
+	if link.Mode() != target.Mode() {
+		t.Errorf("unexpected mode %v, wanted %v", link.Mode(), target.Mode())
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "folder/link"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != "foo" {
+		t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+	}
+	if l, err := os.Readlink(filepath.Join(tmpdir, "folder/link-to-symlink")); err != nil || l != "/etc/passwd" {
+		t.Errorf("expected a copy of the symlink, got %q: %v", l, err)
+	}
+	if stats.TotalBytes != 6 {
+		t.Errorf("unexpected total bytes %d, wanted %d", stats.TotalBytes, 6)
+	}
+
+	tmpdir2 := newTestDir(t)
+	defer os.RemoveAll(tmpdir2)
+	opts = ExtractTarOptions{FlattenHardlinks: true, MaxTotalBytes: 5}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir2, opts); err != ErrSizeLimitExceeded {
+		t.Errorf("unexpected error: %v, wanted %v", err, ErrSizeLimitExceeded)
+	}
+}
+
+func TestExtractTarAllowedTypes(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:     "folder/foo.txt",
+				Typeflag: tar.TypeRegA,
+				Size:     3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/fifo",
+				Typeflag: tar.TypeFifo,
+				Mode:     int64(0644),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{AllowedTypes: []byte{tar.TypeReg, tar.TypeSymlink}}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"folder/foo.txt", "folder/link"} {
+		if _, err := os.Lstat(filepath.Join(tmpdir, name)); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(tmpdir, "folder/fifo")); !os.IsNotExist(err) {
+		t.Errorf("expected folder/fifo not to exist, got: %v", err)
+	}
+
+	tmpdir2 := newTestDir(t)
+	defer os.RemoveAll(tmpdir2)
+	opts.StrictTypes = true
+	err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir2, opts)
+	var entryErr *EntryError
+	if !errors.Is(err, ErrTypeNotAllowed) || !errors.As(err, &entryErr) || entryErr.Path != "folder/fifo" {
+		t.Errorf("expected ErrTypeNotAllowed for folder/fifo, got: %v", err)
+	}
+}
+
+func TestExtractTarMaxFileSize(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "foobar",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 6,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{MaxFileSize: 6, MaxTotalBytes: 9}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	opts.MaxFileSize = 5
+	err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts)
+	if !errors.Is(err, ErrFileTooLarge) || !strings.Contains(err.Error(), "folder/bar.txt") {
+		t.Errorf("expected ErrFileTooLarge for folder/bar.txt, got: %v", err)
+	}
+
+	// The content of the stream is limited whatever the header declares
+	hdr := &tar.Header{
+		Name: "folder/lying.txt",
+		Size: 3,
+	}
+	_, err = extractTestFile(strings.NewReader("foobar"), hdr, tmpdir, ExtractTarOptions{MaxFileSize: 5})
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("expected ErrFileTooLarge, got: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tmpdir, "folder/lying.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected folder/lying.txt not to exist, got: %v", err)
+	}
+}
+
+func TestExtractTarNormalizeSeparators(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder\\foo.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder\\link",
+				Typeflag: tar.TypeLink,
+				Linkname: "folder\\foo.txt",
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{NormalizeSeparators: true}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"folder/foo.txt", "folder/link"} {
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf) != "foo" {
+			t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+		}
+	}
+
+	entries = []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "..\\foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts)
+	if !errors.Is(err, ErrPathEscape) {
+		t.Errorf("expected ErrPathEscape, got: %v", err)
+	}
+}
+
+func TestExtractTarReaderDirContent(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+				Size:     600,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// archive/tar writes no content for directories, so add it after the
+	// header of the directory
+	content := bytes.Repeat([]byte("x"), 1024)
+	b = append(append(append([]byte{}, b[:512]...), content...), b[512:]...)
+
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTarReader(bytes.NewReader(b), tmpdir, ExtractTarOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "folder/foo.txt"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != "foo" {
+		t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+	}
+
+	// The content is not mistaken for the end of the tarball
+	tmpdir2 := newTestDir(t)
+	defer os.RemoveAll(tmpdir2)
+	if err := ExtractTarReader(bytes.NewReader(b[:1024]), tmpdir2, ExtractTarOptions{}); err == nil {
+		t.Errorf("expected error for truncated content")
+	}
+}
+
+func TestExtractSubtree(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "app/config/foo.conf",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "app/config/sub/bar.conf",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "app/configuration",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "app/bin/app",
+				Size: 3,
+				Mode: int64(0755),
+			},
+		},
+	}
+	tests := []struct {
+		opts ExtractTarOptions
+		want []string
+	}{
+		{
+			ExtractTarOptions{},
+			[]string{"app/config/foo.conf", "app/config/sub/bar.conf"},
+		},
+		{
+			ExtractTarOptions{StripComponents: 2},
+			[]string{"foo.conf", "sub/bar.conf"},
+		},
+		{
+			ExtractTarOptions{Whitelist: GlobWhitelist{"**/foo.conf"}},
+			[]string{"app/config/foo.conf"},
+		},
+	}
+	for i, tt := range tests {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		if err := ExtractSubtree(newTestTarReader(t, entries), "app/config/", tmpdir, tt.opts); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		var got []string
+		err := filepath.Walk(tmpdir, func(p string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				rel, _ := filepath.Rel(tmpdir, p)
+				got = append(got, rel)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("#%d: unexpected files %v, wanted %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestExtractTarOnProgress(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+		{
+			contents: "barbaz",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 6,
+				Mode: int64(0644),
+			},
+		},
+	}
+	for _, hint := range []int64{12, 0} {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		var (
+			written  []int64
+			percents []float64
+		)
+		opts := ExtractTarOptions{
+			TotalSizeHint: hint,
+			OnProgress: func(p Progress) {
+				written = append(written, p.Written)
+				if pct, ok := p.Percent(); ok {
+					percents = append(percents, pct)
+				}
+			},
+		}
+		if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := []int64{3, 3, 9}; !reflect.DeepEqual(written, want) {
+			t.Errorf("unexpected progress %v, wanted %v", written, want)
+		}
+		var want []float64
+		if hint > 0 {
+			want = []float64{25, 25, 75}
+		}
+		if !reflect.DeepEqual(percents, want) {
+			t.Errorf("unexpected percentages %v, wanted %v", percents, want)
+		}
+	}
+}
+
+func TestExtractTarMaxLinkLength(t *testing.T) {
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	tests := []struct {
+		target string
+		max    int
+		ok     bool
+	}{
+		{"foo.txt", 0, true},
+		{strings.Repeat("a/", 2048), 0, false},
+		{"foo.txt", 7, true},
+		{"folder/foo.txt", 7, false},
+		{"foo\x00.txt", 0, false},
+	}
+	for i, tt := range tests {
+		hdr := &tar.Header{
+			Name:     fmt.Sprintf("link%d", i),
+			Typeflag: tar.TypeSymlink,
+			Linkname: tt.target,
+		}
+		_, err := extractTestFile(eofReader{}, hdr, tmpdir, ExtractTarOptions{MaxLinkLength: tt.max})
+		if tt.ok && err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if !tt.ok && (err == nil || !strings.Contains(err.Error(), hdr.Name)) {
+			t.Errorf("#%d: expected error naming %q, got: %v", i, hdr.Name, err)
+		}
+	}
+}
+
+func TestExtractTarUnknownPAX(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				PAXRecords: map[string]string{
+					"SCHILY.xattr.user.foo": "bar",
+					"VENDOR.b":              "b",
+					"VENDOR.a":              "a",
+				},
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, ExtractTarOptions{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	opts := ExtractTarOptions{UnknownPAX: RejectUnknownPAX, Overwrite: OverwriteExisting}
+	err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts)
+	if err == nil || !strings.Contains(err.Error(), "VENDOR.a, VENDOR.b") {
+		t.Errorf("expected error listing the unknown records, got: %v", err)
+	}
+	var entryErr *EntryError
+	if !errors.As(err, &entryErr) || entryErr.Path != "folder/foo.txt" {
+		t.Errorf("expected EntryError for %q, got: %v", "folder/foo.txt", err)
+	}
+
+	entries[0].header.PAXRecords = map[string]string{"SCHILY.xattr.user.foo": "bar"}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractTarSymlinkDir(t *testing.T) {
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	real := filepath.Join(tmpdir, "real")
+	if err := os.Mkdir(real, 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dir := filepath.Join(tmpdir, "link")
+	if err := os.Symlink("real", dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	manifest, err := ExtractTarManifest(newTestTarReader(t, entries), dir, ExtractTarOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := filepath.Join(dir, "folder/foo.txt"); len(manifest) != 1 || manifest[0].Path != want {
+		t.Errorf("unexpected manifest %v, wanted path %q", manifest, want)
+	}
+	if _, err := os.Stat(filepath.Join(real, "folder/foo.txt")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, name := range []string{"../escape", "folder/../../escape"} {
+		entries := []*testTarEntry{
+			{
+				contents: "foo",
+				header: &tar.Header{
+					Name: name,
+					Size: 3,
+				},
+			},
+		}
+		err := ExtractTarWithOptions(newTestTarReader(t, entries), dir, ExtractTarOptions{})
+		if !errors.Is(err, ErrPathEscape) {
+			t.Errorf("expected ErrPathEscape for %q, got: %v", name, err)
+		}
+		if _, err := os.Lstat(filepath.Join(tmpdir, "escape")); err == nil {
+			t.Errorf("%q extracted outside of the destination", name)
+		}
+	}
+
+	// A destination that does not exist yet below the symlink
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), filepath.Join(dir, "new"), ExtractTarOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(real, "new/folder/foo.txt")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractTarResumeFrom(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0750),
+			},
+		},
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		entries = append(entries, &testTarEntry{
+			contents: name,
+			header: &tar.Header{
+				Name: "folder/" + name,
+				Size: 1,
+				Mode: int64(0644),
+			},
+		})
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	// Interrupt the extraction after folder/a
+	opts := ExtractTarOptions{MaxEntries: 2}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != ErrTooManyEntries {
+		t.Fatalf("expected ErrTooManyEntries, got: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpdir, "folder/a"), []byte("kept"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts = ExtractTarOptions{ResumeFrom: "./folder/a"}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, want := range map[string]string{"a": "kept", "b": "b", "c": "c"} {
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "folder", name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf) != want {
+			t.Errorf("unexpected contents of %s, wanted: %s, got: %s", name, want, buf)
+		}
+	}
+	fi, err := os.Stat(filepath.Join(tmpdir, "folder"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi.Mode() != os.ModeDir|0750 {
+		t.Errorf("unexpected mode %v, wanted %v", fi.Mode(), os.ModeDir|0750)
+	}
+
+	opts = ExtractTarOptions{ResumeFrom: "folder/d"}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err == nil {
+		t.Errorf("expected error for entry to resume from not found")
+	}
+}
+
+func TestExtractTarNames(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  byte
+		// want is where the entry is extracted, or empty if it is rejected
+		want string
+	}{
+		{"foo//bar", tar.TypeReg, "foo/bar"},
+		{"foo/./bar", tar.TypeReg, "foo/bar"},
+		{"./foo", tar.TypeReg, "foo"},
+		{"./", tar.TypeDir, "."},
+		{".", tar.TypeReg, ""},
+		{"foo/..", tar.TypeReg, ""},
+		{"", tar.TypeReg, ""},
+		{"", tar.TypeDir, ""},
+		{"/etc/foo", tar.TypeReg, ""},
+		{"//foo", tar.TypeDir, ""},
+	}
+	for i, tt := range tests {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		entries := []*testTarEntry{
+			{
+				header: &tar.Header{
+					Name:     tt.name,
+					Typeflag: tt.typ,
+					Mode:     int64(0755),
+				},
+			},
+		}
+		err := ExtractTar(newTestTarReader(t, entries), tmpdir, nil)
+		if tt.want == "" {
+			if !errors.Is(err, ErrInvalidName) {
+				t.Errorf("#%d: expected ErrInvalidName for %q, got: %v", i, tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(tmpdir, tt.want))
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if fi.IsDir() != (tt.typ == tar.TypeDir) {
+			t.Errorf("#%d: unexpected mode %v for %q", i, fi.Mode(), tt.want)
+		}
+	}
+}
+
+func TestExtractTarStripCommonPrefix(t *testing.T) {
+	tests := []struct {
+		names []string
+		strip int
+		want  []string
+	}{
+		{
+			[]string{"project/", "project/src/main.go", "project/README"},
+			0,
+			[]string{"README", "src/main.go"},
+		},
+		{
+			[]string{"a/b/file"},
+			0,
+			[]string{"file"},
+		},
+		{
+			[]string{"x/foo", "y/bar"},
+			0,
+			[]string{"x/foo", "y/bar"},
+		},
+		{
+			[]string{"README", "src/main.go"},
+			0,
+			[]string{"README", "src/main.go"},
+		},
+		{
+			[]string{"top/project/src/main.go", "top/project/README"},
+			1,
+			[]string{"README", "src/main.go"},
+		},
+		{
+			[]string{"./", "./project/", "./project/src/main.go", "./project/README"},
+			0,
+			[]string{"README", "src/main.go"},
+		},
+	}
+	for i, tt := range tests {
+		var entries []*testTarEntry
+		for _, name := range tt.names {
+			hdr := &tar.Header{Name: name, Mode: int64(0755)}
+			if strings.HasSuffix(name, "/") {
+				hdr.Typeflag = tar.TypeDir
+			}
+			entries = append(entries, &testTarEntry{header: hdr})
+		}
+		b, err := newTestTarBytes(entries)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var gz bytes.Buffer
+		gw := gzip.NewWriter(&gz)
+		if _, err := gw.Write(b); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		opts := ExtractTarOptions{StripCommonPrefix: true, StripComponents: tt.strip}
+		e := Extractor{Options: opts}
+		for _, extract := range []func(dir string) error{
+			func(dir string) error { return ExtractTarReader(bytes.NewReader(b), dir, opts) },
+			// Not seekable
+			func(dir string) error { return e.ExtractArchive(bytes.NewReader(gz.Bytes()), dir) },
+		} {
+			tmpdir := newTestDir(t)
+			defer os.RemoveAll(tmpdir)
+			if err := extract(tmpdir); err != nil {
+				t.Fatalf("#%d: unexpected error: %v", i, err)
+			}
+			var got []string
+			err := filepath.Walk(tmpdir, func(p string, info os.FileInfo, err error) error {
+				if err == nil && info.Mode().IsRegular() {
+					rel, _ := filepath.Rel(tmpdir, p)
+					got = append(got, rel)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatalf("#%d: unexpected error: %v", i, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("#%d: unexpected files %v, wanted %v", i, got, tt.want)
+			}
+		}
+	}
+
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{StripCommonPrefix: true}
+	if err := ExtractTarWithOptions(newTestTarReader(t, nil), tmpdir, opts); err == nil {
+		t.Errorf("expected error for StripCommonPrefix with a tar.Reader")
+	}
+
+	// A stream that cannot seek is not spooled past the size limit
+	big := strings.Repeat("x", 1<<20)
+	b, err := newTestTarBytes([]*testTarEntry{
+		{contents: big, header: &tar.Header{Name: "project/big", Size: int64(len(big)), Mode: 0644}},
+		{contents: big, header: &tar.Header{Name: "project/big2", Size: int64(len(big)), Mode: 0644}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cr := &countingReader{r: bytes.NewReader(b)}
+	opts = ExtractTarOptions{StripCommonPrefix: true, MaxTotalBytes: int64(len(big))}
+	if err := ExtractTarReader(cr, tmpdir, opts); !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Errorf("expected ErrSizeLimitExceeded, got: %v", err)
+	}
+	if cr.n >= int64(len(b)) {
+		t.Errorf("unexpected %d bytes read, wanted less than %d", cr.n, len(b))
+	}
+}
+
+func TestExtractTarImplicitDirMode(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0711),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/a/b/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "implicit/bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	tests := []struct {
+		opts ExtractTarOptions
+		want map[string]os.FileMode
+	}{
+		{
+			ExtractTarOptions{},
+			map[string]os.FileMode{
+				"folder/a":   os.ModeDir | 0755,
+				"folder/a/b": os.ModeDir | 0755,
+				"implicit":   os.ModeDir | 0755,
+			},
+		},
+		{
+			ExtractTarOptions{DefaultDirMode: 0700},
+			map[string]os.FileMode{
+				"folder/a":   os.ModeDir | 0700,
+				"folder/a/b": os.ModeDir | 0700,
+				"implicit":   os.ModeDir | 0700,
+			},
+		},
+		{
+			ExtractTarOptions{InheritParentMode: true},
+			map[string]os.FileMode{
+				"folder/a":   os.ModeDir | 0711,
+				"folder/a/b": os.ModeDir | 0711,
+				"implicit":   os.ModeDir | 0750,
+			},
+		},
+	}
+	for i, tt := range tests {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		if err := os.Chmod(tmpdir, 0750); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, tt.opts); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		for name, mode := range tt.want {
+			fi, err := os.Lstat(filepath.Join(tmpdir, name))
+			if err != nil {
+				t.Fatalf("#%d: unexpected error: %v", i, err)
+			}
+			if fi.Mode() != mode {
+				t.Errorf("#%d: %s: unexpected mode %v, wanted %v", i, name, fi.Mode(), mode)
+			}
+		}
+	}
+
+	// Nothing is inherited from outside of the destination
+	parent := newTestDir(t)
+	defer os.RemoveAll(parent)
+	if err := os.Chmod(parent, 0711); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpdir := filepath.Join(parent, "dest")
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, ExtractTarOptions{InheritParentMode: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"", "implicit"} {
+		fi, err := os.Lstat(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fi.Mode() != os.ModeDir|0755 {
+			t.Errorf("%q: unexpected mode %v, wanted %v", name, fi.Mode(), os.ModeDir|0755)
+		}
+	}
+}
+
+func TestExtractTarOnUnsupported(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "custom",
+			header: &tar.Header{
+				Name:     "custom",
+				Typeflag: 'Z',
+				Size:     6,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	var handled []string
+	opts := ExtractTarOptions{
+		OnUnsupported: func(hdr *tar.Header, r io.Reader) error {
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			handled = append(handled, hdr.Name+":"+string(b))
+			return nil
+		},
+	}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"custom:custom"}; !reflect.DeepEqual(handled, want) {
+		t.Errorf("unexpected handled entries %v, wanted %v", handled, want)
+	}
+	if _, err := os.Lstat(filepath.Join(tmpdir, "custom")); !os.IsNotExist(err) {
+		t.Errorf("expected custom not to be extracted, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpdir, "foo.txt")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	errCustom := errors.New("custom error")
+	opts.OnUnsupported = func(*tar.Header, io.Reader) error {
+		return errCustom
+	}
+	tmpdir2 := newTestDir(t)
+	defer os.RemoveAll(tmpdir2)
+	err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir2, opts)
+	var entryErr *EntryError
+	if !errors.As(err, &entryErr) || entryErr.Path != "custom" || !errors.Is(err, errCustom) {
+		t.Errorf("expected EntryError for custom wrapping the callback error, got: %v", err)
+	}
+}
+
+func TestExtractTarPathEscapeAllTypes(t *testing.T) {
+	headers := []*tar.Header{
+		{Name: "../outside", Size: 3},
+		{Name: "folder/../../outside", Size: 3},
+		{Name: "../outside/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "../outside", Typeflag: tar.TypeFifo, Mode: 0644},
+		{Name: "../outside", Typeflag: tar.TypeLink, Linkname: "foo.txt"},
+	}
+	for _, hdr := range headers {
+		parent := newTestDir(t)
+		defer os.RemoveAll(parent)
+		tmpdir := filepath.Join(parent, "dest")
+		if err := os.Mkdir(tmpdir, 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var contents string
+		if hdr.Size > 0 {
+			contents = "bar"
+		}
+		entries := []*testTarEntry{
+			{contents: "foo", header: &tar.Header{Name: "foo.txt", Size: 3}},
+			{contents: contents, header: hdr},
+		}
+		err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, ExtractTarOptions{})
+		if !errors.Is(err, ErrPathEscape) {
+			t.Errorf("%s (%c): expected ErrPathEscape, got: %v", hdr.Name, hdr.Typeflag, err)
+		}
+		if _, err := os.Lstat(filepath.Join(parent, "outside")); !os.IsNotExist(err) {
+			t.Errorf("%s (%c): expected nothing outside of the destination, got: %v", hdr.Name, hdr.Typeflag, err)
+		}
+	}
+}
+
+func TestCheckInside(t *testing.T) {
+	tests := []struct {
+		dir, p string
+		ok     bool
+	}{
+		{"/tmp/dest", "/tmp/dest", true},
+		{"/tmp/dest", "/tmp/dest/foo", true},
+		{"/tmp/dest/", "/tmp/dest/foo/../bar", true},
+		{"/tmp/dest", "/tmp/destination", false},
+		{"/tmp/dest", "/tmp/dest/../outside", false},
+		{"/tmp/dest", "/tmp", false},
+		{"/", "/foo", true},
+		{".", "foo", true},
+		{".", ".", true},
+		{".", "../foo", false},
+		{"dest", "dest/foo", true},
+		{"dest", "destination/foo", false},
+	}
+	for _, tt := range tests {
+		err := checkInside(tt.dir, tt.p)
+		if tt.ok && err != nil {
+			t.Errorf("%q in %q: unexpected error: %v", tt.p, tt.dir, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrPathEscape) {
+			t.Errorf("%q in %q: expected ErrPathEscape, got: %v", tt.p, tt.dir, err)
+		}
+	}
+}
+
+func TestExtractTarCanonicalizeModes(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(01700),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: int64(0600),
+			},
+		},
+		{
+			contents: "#!/bin/sh",
+			header: &tar.Header{
+				Name: "folder/setuid",
+				Size: 9,
+				Mode: int64(04711),
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder/writable",
+				Size: 3,
+				Mode: int64(0666),
+			},
+		},
+	}
+	want := map[string]os.FileMode{
+		"folder":          os.ModeDir | 0755,
+		"folder/foo.txt":  0644,
+		"folder/setuid":   0755,
+		"folder/writable": 0644,
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{CanonicalizeModes: true}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, mode := range want {
+		fi, err := os.Lstat(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fi.Mode() != mode {
+			t.Errorf("%s: unexpected mode %v, wanted %v", name, fi.Mode(), mode)
+		}
+	}
+}
+
+func TestExtractTarCleanupOnError(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "../bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	for _, cleanup := range []bool{false, true} {
+		parent := newTestDir(t)
+		defer os.RemoveAll(parent)
+		tmpdir := filepath.Join(parent, "dest")
+		opts := ExtractTarOptions{CleanupOnError: cleanup}
+		if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err == nil {
+			t.Fatalf("expected error")
+		}
+		_, err := os.Lstat(filepath.Join(tmpdir, "folder/foo.txt"))
+		if cleanup && !os.IsNotExist(err) {
+			t.Errorf("expected the destination to be removed, got: %v", err)
+		}
+		if !cleanup && err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	// Failing before extracting anything leaves the destination alone
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{CleanupOnError: true, DestPrefix: "/abs"}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := os.Stat(tmpdir); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// What was in an existing destination is kept, whether the extraction
+	// fails before the first entry or after some were extracted
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, ctx := range []context.Context{ctx, context.Background()} {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		for _, name := range []string{"keep.txt", "folder/keep.txt"} {
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(tmpdir, name)), 0755); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(tmpdir, name), []byte("keep"), 0644); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		entries := []*testTarEntry{
+			{
+				contents: "new",
+				header: &tar.Header{
+					Name: "new/foo.txt",
+					Size: 3,
+				},
+			},
+			entries[0],
+			entries[1],
+		}
+		opts := ExtractTarOptions{CleanupOnError: true}
+		if err := ExtractTarContext(ctx, newTestTarReader(t, entries), tmpdir, opts); err == nil {
+			t.Fatalf("expected error")
+		}
+		for _, name := range []string{"keep.txt", "folder/keep.txt"} {
+			if _, err := os.Stat(filepath.Join(tmpdir, name)); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+		for _, name := range []string{"new", "folder/foo.txt"} {
+			if _, err := os.Lstat(filepath.Join(tmpdir, name)); !os.IsNotExist(err) {
+				t.Errorf("expected %s to be removed, got: %v", name, err)
+			}
+		}
+	}
+}
+
+func TestExtractTarRelativeSymlinksInside(t *testing.T) {
+	tests := []struct {
+		name, target string
+		ok           bool
+	}{
+		{"bin/sh", "../usr/bin/sh", true},
+		{"usr/lib64", "lib", true},
+		{"a/b/c", "../../usr/bin/sh", true},
+		{"a/b/d", "../b/../../usr", true},
+		{"a/b/e", "./../../../usr", false},
+		{"bin/evil", "../../etc/passwd", false},
+		{"evil", "..", false},
+		{"a/b/dots", "../../a/../..", false},
+	}
+	for _, tt := range tests {
+		entries := []*testTarEntry{
+			{
+				contents: "#!/bin/sh",
+				header: &tar.Header{
+					Name: "usr/bin/sh",
+					Size: 9,
+				},
+			},
+			{
+				header: &tar.Header{
+					Name:     tt.name,
+					Linkname: tt.target,
+					Typeflag: tar.TypeSymlink,
+				},
+			},
+		}
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, ExtractTarOptions{})
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%s -> %s: unexpected error: %v", tt.name, tt.target, err)
+				continue
+			}
+			target, err := os.Readlink(filepath.Join(tmpdir, tt.name))
+			if err != nil {
+				t.Errorf("%s -> %s: unexpected error: %v", tt.name, tt.target, err)
+			} else if target != tt.target {
+				t.Errorf("%s: unexpected target %q, wanted %q", tt.name, target, tt.target)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrInsecureLink) {
+			t.Errorf("%s -> %s: expected ErrInsecureLink, got: %v", tt.name, tt.target, err)
+		}
+	}
+
+	// The links are followed from their own directory
+	entries := []*testTarEntry{
+		{
+			contents: "#!/bin/sh",
+			header: &tar.Header{
+				Name: "usr/bin/sh",
+				Size: 9,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "bin",
+				Linkname: "usr/bin",
+				Typeflag: tar.TypeSymlink,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "usr/sbin/sh",
+				Linkname: "../../bin/sh",
+				Typeflag: tar.TypeSymlink,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, ExtractTarOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(tmpdir, "usr/sbin/sh"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != "#!/bin/sh" {
+		t.Errorf("unexpected contents %q", buf)
+	}
+}
+
+func TestExtractTarContentFilter(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "password=@PASSWORD@",
+			header: &tar.Header{
+				Name: "etc/config",
+				Size: 19,
+			},
+		},
+		{
+			contents: "@PASSWORD@",
+			header: &tar.Header{
+				Name: "etc/other",
+				Size: 10,
+			},
+		},
+	}
+	filter := func(hdr *tar.Header, r io.Reader) (io.Reader, error) {
+		if hdr.Name != "etc/config" {
+			return r, nil
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return strings.NewReader(strings.Replace(string(b), "@PASSWORD@", "hunter2hunter2", -1)), nil
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{ContentFilter: filter}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, want := range map[string]string{
+		"etc/config": "password=hunter2hunter2",
+		"etc/other":  "@PASSWORD@",
+	} {
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf) != want {
+			t.Errorf("%s: unexpected contents %q, wanted %q", name, buf, want)
+		}
+	}
+
+	// The hash is of the content in the tarball, even if the filter
+	// doesn't read it all
+	sum := sha256.Sum256([]byte("password=@PASSWORD@"))
+	opts = ExtractTarOptions{
+		ContentFilter: func(*tar.Header, io.Reader) (io.Reader, error) {
+			return strings.NewReader("replaced"), nil
+		},
+		FileHashes: map[string]string{"etc/config": hex.EncodeToString(sum[:])},
+	}
+	tmpdir2 := newTestDir(t)
+	defer os.RemoveAll(tmpdir2)
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries[:1]), tmpdir2, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	errFilter := errors.New("filter error")
+	opts = ExtractTarOptions{
+		ContentFilter: func(*tar.Header, io.Reader) (io.Reader, error) {
+			return nil, errFilter
+		},
+	}
+	tmpdir3 := newTestDir(t)
+	defer os.RemoveAll(tmpdir3)
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir3, opts); !errors.Is(err, errFilter) {
+		t.Errorf("expected the filter error, got: %v", err)
+	}
+}
+
+func TestExtractTarRequireEndMarker(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// tar.Writer ends the tarball with the two zero blocks of the marker
+	full, oneBlock, none := b, b[:len(b)-512], b[:len(b)-1024]
+	opts := ExtractTarOptions{RequireEndMarker: true}
+	tests := []struct {
+		b    []byte
+		opts ExtractTarOptions
+		ok   bool
+	}{
+		{full, opts, true},
+		{oneBlock, opts, false},
+		{none, opts, false},
+		{none, ExtractTarOptions{}, true},
+	}
+	for i, tt := range tests {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		err := ExtractTarReader(bytes.NewReader(tt.b), tmpdir, tt.opts)
+		if tt.ok && err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrTruncatedArchive) {
+			t.Errorf("#%d: expected ErrTruncatedArchive, got: %v", i, err)
+		}
+	}
+
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTarWithOptions(tar.NewReader(bytes.NewReader(full)), tmpdir, opts); err == nil {
+		t.Errorf("expected RequireEndMarker to be rejected with a tar.Reader")
+	}
+}
+
+// testMetrics records the measurements it receives
+type testMetrics struct {
+	files     int
+	bytes     int64
+	durations []time.Duration
+}
+
+func (m *testMetrics) IncFiles()                       { m.files++ }
+func (m *testMetrics) AddBytes(n int64)                { m.bytes += n }
+func (m *testMetrics) ObserveDuration(d time.Duration) { m.durations = append(m.durations, d) }
+
+func TestExtractTarMetrics(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "barbaz",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 6,
+			},
+		},
+		{
+			contents: "skipped",
+			header: &tar.Header{
+				Name: "skipped.txt",
+				Size: 7,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	m := &testMetrics{}
+	opts := ExtractTarOptions{Metrics: m, Exclude: []string{"skipped.txt"}}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.files != 3 || m.bytes != 9 || len(m.durations) != 1 {
+		t.Errorf("unexpected metrics: %d files, %d bytes, durations %v", m.files, m.bytes, m.durations)
+	}
+
+	// Failed extractions are timed too
+	m = &testMetrics{}
+	opts = ExtractTarOptions{Metrics: m, MaxEntries: 1}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err == nil {
+		t.Fatalf("expected error")
+	}
+	if len(m.durations) != 1 {
+		t.Errorf("unexpected durations %v", m.durations)
+	}
+}
+
+func TestExtractTarEmptyEntries(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name: "marker",
+				Mode: int64(0600),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/.keep",
+				Typeflag: tar.TypeRegA,
+				Mode:     int64(0644),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "empty/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0700),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/empty",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0750),
+			},
+		},
+	}
+	want := map[string]os.FileMode{
+		"marker":       0600,
+		"folder/.keep": 0644,
+		"empty":        os.ModeDir | 0700,
+		"folder/empty": os.ModeDir | 0750,
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	extract := map[string]func(dir string) error{
+		"ExtractTarWithOptions": func(dir string) error {
+			return ExtractTarWithOptions(tar.NewReader(bytes.NewReader(b)), dir, ExtractTarOptions{})
+		},
+		"ExtractTarReader": func(dir string) error {
+			return ExtractTarReader(bytes.NewReader(b), dir, ExtractTarOptions{})
+		},
+		"Parallelism": func(dir string) error {
+			return ExtractTarWithOptions(tar.NewReader(bytes.NewReader(b)), dir, ExtractTarOptions{Parallelism: 4})
+		},
+	}
+	for how, f := range extract {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		if err := f(tmpdir); err != nil {
+			t.Fatalf("%s: unexpected error: %v", how, err)
+		}
+		for name, mode := range want {
+			fi, err := os.Lstat(filepath.Join(tmpdir, name))
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", how, err)
+				continue
+			}
+			if fi.Mode() != mode {
+				t.Errorf("%s: %s: unexpected mode %v, wanted %v", how, name, fi.Mode(), mode)
+			}
+			if fi.Mode().IsRegular() && fi.Size() != 0 {
+				t.Errorf("%s: %s: unexpected size %d", how, name, fi.Size())
+			}
+			if fi.IsDir() {
+				children, err := ioutil.ReadDir(filepath.Join(tmpdir, name))
+				if err != nil {
+					t.Errorf("%s: unexpected error: %v", how, err)
+				} else if len(children) != 0 {
+					t.Errorf("%s: %s: unexpected children %v", how, name, children)
+				}
+			}
+		}
+	}
+}
+
+func TestExtractTarPathConflict(t *testing.T) {
+	tests := [][]*testTarEntry{
+		{
+			{contents: "foo", header: &tar.Header{Name: "foo", Size: 3}},
+			{contents: "bar", header: &tar.Header{Name: "foo/bar", Size: 3}},
+		},
+		{
+			{contents: "foo", header: &tar.Header{Name: "foo", Size: 3}},
+			{header: &tar.Header{Name: "foo/deep/dir/", Typeflag: tar.TypeDir, Mode: 0755}},
+		},
+		{
+			{contents: "bar", header: &tar.Header{Name: "foo/bar", Size: 3}},
+			{contents: "foo", header: &tar.Header{Name: "foo", Size: 3}},
+		},
+		{
+			{contents: "bar", header: &tar.Header{Name: "foo/deep/bar", Size: 3}},
+			{header: &tar.Header{Name: "foo", Typeflag: tar.TypeSymlink, Linkname: "elsewhere"}},
+		},
+	}
+	for i, entries := range tests {
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, ExtractTarOptions{})
+		if !errors.Is(err, ErrPathConflict) {
+			t.Errorf("#%d: expected ErrPathConflict, got: %v", i, err)
+		}
+	}
+
+	// A directory entry after its content is no conflict
+	entries := []*testTarEntry{
+		{contents: "bar", header: &tar.Header{Name: "foo/bar", Size: 3}},
+		{header: &tar.Header{Name: "foo/", Typeflag: tar.TypeDir, Mode: 0755}},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, ExtractTarOptions{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExtractTarAtomicFiles(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: 0750,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	p := filepath.Join(tmpdir, "folder/foo.txt")
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(p, []byte("old"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	noTemp := func() {
+		names, err := ioutil.ReadDir(filepath.Dir(p))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(names) != 1 {
+			t.Errorf("expected only foo.txt, got %d files", len(names))
+		}
+	}
+
+	// A failed write leaves the previous file in place
+	opts := ExtractTarOptions{AtomicFiles: true, FileHashes: map[string]string{"folder/foo.txt": "00"}}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err == nil {
+		t.Fatalf("expected error")
+	}
+	buf, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != "old" {
+		t.Errorf("unexpected contents, wanted: %s, got: %s", "old", buf)
+	}
+	noTemp()
+
+	opts = ExtractTarOptions{AtomicFiles: true}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf, err = ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != "foo" {
+		t.Errorf("unexpected contents, wanted: %s, got: %s", "foo", buf)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi.Mode().Perm() != 0750 {
+		t.Errorf("unexpected mode, wanted: %v, got: %v", os.FileMode(0750), fi.Mode().Perm())
+	}
+	noTemp()
+
+	opts = ExtractTarOptions{AtomicFiles: true, Overwrite: ErrorOnExisting}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err == nil {
+		t.Errorf("expected error")
+	}
+	noTemp()
+}
+
+func TestExtractTarMetadataFilter(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     0700,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: 0600,
+				Uid:  1000,
+				Gid:  1001,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 3,
+				Mode: 04755,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	umask := os.FileMode(0077)
+	calls := make(map[string]int)
+	opts := ExtractTarOptions{
+		Umask: &umask,
+		MetadataFilter: func(hdr *tar.Header) (os.FileMode, int, int) {
+			calls[hdr.Name]++
+			if hdr.Name == "folder/foo.txt" {
+				return 0644, hdr.Uid + 1, hdr.Gid + 1
+			}
+			return hdr.FileInfo().Mode(), -1, -1
+		},
+	}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, e := range entries {
+		if n := calls[e.header.Name]; n != 1 {
+			t.Errorf("%s: expected MetadataFilter to be called once, got %d calls", e.header.Name, n)
+		}
+	}
+	for name, want := range map[string]os.FileMode{
+		"folder":         os.ModeDir | 0700,
+		"folder/foo.txt": 0644,
+		"folder/bar.txt": os.ModeSetuid | 0755,
+	} {
+		fi, err := os.Lstat(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if fi.Mode() != want {
+			t.Errorf("%s: unexpected mode, wanted: %v, got: %v", name, want, fi.Mode())
+		}
+	}
+
+	if os.Geteuid() != 0 {
+		return
+	}
+	fi, err := os.Lstat(filepath.Join(tmpdir, "folder/foo.txt"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	if st.Uid != 1001 || st.Gid != 1002 {
+		t.Errorf("unexpected owner %d:%d, wanted %d:%d", st.Uid, st.Gid, 1001, 1002)
+	}
+}
+
+func TestExtractTarReadOnlyDir(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0555),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/subfolder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0555),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/subfolder/foo.txt",
+				Size: 3,
+				Mode: 0644,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 3,
+				Mode: 0644,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer func() {
+		os.Chmod(filepath.Join(tmpdir, "folder/subfolder"), 0755)
+		os.Chmod(filepath.Join(tmpdir, "folder"), 0755)
+		os.RemoveAll(tmpdir)
+	}()
+	if err := ExtractTar(newTestTarReader(t, entries), tmpdir, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"folder", "folder/subfolder"} {
+		fi, err := os.Lstat(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fi.Mode().Perm() != 0555 {
+			t.Errorf("%s: unexpected mode, wanted: %v, got: %v", name, os.FileMode(0555), fi.Mode().Perm())
+		}
+	}
+	for name, want := range map[string]string{"folder/subfolder/foo.txt": "foo", "folder/bar.txt": "bar"} {
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else if string(buf) != want {
+			t.Errorf("%s: unexpected contents, wanted: %s, got: %s", name, want, buf)
+		}
+	}
+}
+
+func TestExtractTarDirReplacedBySymlink(t *testing.T) {
+	victim := newTestDir(t)
+	defer os.RemoveAll(victim)
+	if err := os.Chmod(victim, 0777); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mtime := time.Unix(1234567890, 0)
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "foo/",
+				Typeflag: tar.TypeDir,
+				Mode:     0700,
+				ModTime:  mtime,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "foo",
+				Typeflag: tar.TypeSymlink,
+				Linkname: victim,
+			},
+		},
+	}
+	extract := []func(tr *tar.Reader, dir string, opts ExtractTarOptions) error{
+		ExtractTarWithOptions,
+		func(tr *tar.Reader, dir string, opts ExtractTarOptions) error {
+			return ExtractTarFS(OSFilesystem{}, tr, dir, opts)
+		},
+	}
+	for _, opts := range []ExtractTarOptions{{}, {RestoreTimes: true}} {
+		for _, f := range extract {
+			tmpdir := newTestDir(t)
+			defer os.RemoveAll(tmpdir)
+			if err := f(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			fi, err := os.Lstat(victim)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fi.Mode().Perm() != 0777 {
+				t.Errorf("expected the mode of the symlink target to be left alone, got: %v", fi.Mode().Perm())
+			}
+			if fi.ModTime().Equal(mtime) {
+				t.Errorf("expected the times of the symlink target to be left alone")
+			}
+		}
+	}
+}
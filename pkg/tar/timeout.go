@@ -0,0 +1,74 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrEntryTimeout is returned when reading the content of an entry takes
+// longer than ExtractTarOptions.PerEntryTimeout
+var ErrEntryTimeout = errors.New("timeout reading entry content")
+
+// entryReader returns the reader of the content of the current entry of tr
+func (x *extraction) entryReader(r io.Reader) io.Reader {
+	r = &ctxReader{x.ctx, r}
+	if x.opts.PerEntryTimeout > 0 {
+		r = &timeoutReader{r: r, deadline: time.Now().Add(x.opts.PerEntryTimeout)}
+	}
+	return r
+}
+
+// timeoutReader reads from r until deadline, even if a read blocks
+type timeoutReader struct {
+	r        io.Reader
+	deadline time.Time
+	// buf is read into by the goroutines, since one that timed out may
+	// still write to it
+	buf []byte
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (tr *timeoutReader) Read(p []byte) (int, error) {
+	remaining := time.Until(tr.deadline)
+	if remaining <= 0 {
+		return 0, ErrEntryTimeout
+	}
+	if len(tr.buf) < len(p) {
+		tr.buf = make([]byte, len(p))
+	}
+	buf := tr.buf[:len(p)]
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := tr.r.Read(buf)
+		done <- readResult{n, err}
+	}()
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return copy(p, buf[:res.n]), res.err
+	case <-timer.C:
+		// The read goes on in the background, so buf is given up
+		tr.buf = nil
+		return 0, ErrEntryTimeout
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// blockingReader blocks its reads until unblock is closed
+type blockingReader struct {
+	unblock chan struct{}
+}
+
+func (br blockingReader) Read(p []byte) (int, error) {
+	<-br.unblock
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestExtractTarPerEntryTimeout(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "hello",
+			header: &tar.Header{
+				Name: "hello.txt",
+				Size: 5,
+			},
+		},
+	}
+	b, err := newTestTarBytes(entries)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The stream stalls after the header of the first entry
+	br := blockingReader{make(chan struct{})}
+	defer close(br.unblock)
+	tr := tar.NewReader(io.MultiReader(bytes.NewReader(b[:512]), br))
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	start := time.Now()
+	err = ExtractTarWithOptions(tr, tmpdir, ExtractTarOptions{PerEntryTimeout: 50 * time.Millisecond})
+	if !errors.Is(err, ErrEntryTimeout) {
+		t.Errorf("expected ErrEntryTimeout, got: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("extraction took %v, expected it to time out", d)
+	}
+
+	// A stream that doesn't stall is extracted normally
+	tmpdir2 := newTestDir(t)
+	defer os.RemoveAll(tmpdir2)
+	tr = tar.NewReader(bytes.NewReader(b))
+	if err := ExtractTarWithOptions(tr, tmpdir2, ExtractTarOptions{PerEntryTimeout: time.Minute}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
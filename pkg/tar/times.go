@@ -0,0 +1,79 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"errors"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	atFdcwd           = -0x64
+	atSymlinkNofollow = 0x100
+)
+
+// entryTimes returns the access and modification times to give the file
+// extracted from the entry described by hdr, or false if its times are left
+// unchanged. Headers without an access time get the modification time for
+// both.
+func (opts ExtractTarOptions) entryTimes(hdr *tar.Header) (time.Time, time.Time, bool) {
+	if t := opts.ClampMTime; t != nil {
+		return *t, *t, true
+	}
+	if !opts.RestoreTimes {
+		return time.Time{}, time.Time{}, false
+	}
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	return atime, hdr.ModTime, true
+}
+
+// restoreTimes sets the access and modification times of p of fs, extracted
+// from the entry described by hdr, as configured by opts
+func restoreTimes(fs Filesystem, p string, hdr *tar.Header, opts ExtractTarOptions) error {
+	atime, mtime, ok := opts.entryTimes(hdr)
+	if !ok {
+		return nil
+	}
+	err := fs.Chtimes(p, atime, mtime)
+	// Old kernels cannot change the times of symlinks
+	if hdr.Typeflag == tar.TypeSymlink && errors.Is(err, syscall.ENOSYS) {
+		return nil
+	}
+	return err
+}
+
+// lutimes is like os.Chtimes, but does not follow symlinks
+func lutimes(path string, atime, mtime time.Time) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	ts := [2]syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+	fd := atFdcwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(fd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts)), atSymlinkNofollow, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
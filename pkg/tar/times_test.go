@@ -0,0 +1,161 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExtractTarRestoreTimes(t *testing.T) {
+	mtime := time.Date(2014, 12, 1, 10, 0, 0, 0, time.UTC)
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+				ModTime:  mtime,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:    "folder/foo.txt",
+				Size:    3,
+				ModTime: mtime.Add(time.Hour),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink.txt",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+				ModTime:  mtime.Add(2 * time.Hour),
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{RestoreTimes: true}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, entry := range entries {
+		fi, err := os.Lstat(filepath.Join(tmpdir, entry.header.Name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !fi.ModTime().Equal(entry.header.ModTime) {
+			t.Errorf("%s: unexpected mtime %v, wanted %v", entry.header.Name, fi.ModTime(), entry.header.ModTime)
+		}
+	}
+}
+
+func TestExtractTarClampMTime(t *testing.T) {
+	mtime := time.Date(2014, 12, 1, 10, 0, 0, 0, time.UTC)
+	clamp := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+				ModTime:  mtime,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name:    "folder/foo.txt",
+				Size:    3,
+				ModTime: mtime,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link",
+				Linkname: "foo.txt",
+				Typeflag: tar.TypeSymlink,
+				ModTime:  mtime,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name:    "implicit/deep/bar.txt",
+				Size:    3,
+				ModTime: mtime,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{ClampMTime: &clamp, RestoreTimes: true}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"folder", "folder/foo.txt", "folder/link", "implicit", "implicit/deep", "implicit/deep/bar.txt"} {
+		fi, err := os.Lstat(filepath.Join(tmpdir, name))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !fi.ModTime().Equal(clamp) {
+			t.Errorf("%s: unexpected mtime %v, wanted %v", name, fi.ModTime(), clamp)
+		}
+	}
+}
+
+func TestExtractTarClampMTimeInsecureParent(t *testing.T) {
+	clamp := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	victim := newTestDir(t)
+	defer os.RemoveAll(victim)
+	if err := os.Mkdir(filepath.Join(victim, "b"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "a",
+				Linkname: victim,
+				Typeflag: tar.TypeSymlink,
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "a/b/x",
+				Size: 3,
+			},
+		},
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	opts := ExtractTarOptions{ClampMTime: &clamp, ContinueOnError: true}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); !errors.Is(err, ErrInsecureLink) {
+		t.Fatalf("expected ErrInsecureLink, got: %v", err)
+	}
+	fi, err := os.Lstat(filepath.Join(victim, "b"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi.ModTime().Equal(clamp) {
+		t.Errorf("expected the times outside of the destination to be left alone")
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// TarIssueCategory classifies the problems reported by ValidateTar
+type TarIssueCategory string
+
+const (
+	IssueInvalidPath     TarIssueCategory = "invalid-path"
+	IssuePathTraversal   TarIssueCategory = "path-traversal"
+	IssueInsecureLink    TarIssueCategory = "insecure-link"
+	IssueDuplicateEntry  TarIssueCategory = "duplicate-entry"
+	IssueUnsupportedType TarIssueCategory = "unsupported-type"
+	IssuePathConflict    TarIssueCategory = "path-conflict"
+)
+
+// TarIssue describes a problem found in a tarball by ValidateTar
+type TarIssue struct {
+	// Path is the cleaned path of the entry in the tarball
+	Path     string
+	Category TarIssueCategory
+	Message  string
+}
+
+// ValidateTar reads a tarball (from a tar.Reader) and reports the problems
+// ExtractTarWithOptions would run into when extracting it as configured by
+// opts into an empty directory, without writing anything to disk. The
+// whitelist and the options relocating entries are applied before checking
+// them. The error is only set when the tarball cannot be read.
+func ValidateTar(tr *tar.Reader, opts ExtractTarOptions) ([]TarIssue, error) {
+	var issues []TarIssue
+	report := func(hdr *tar.Header, category TarIssueCategory, err error) {
+		issues = append(issues, TarIssue{
+			Path:     filepath.Clean(hdr.Name),
+			Category: category,
+			Message:  err.Error(),
+		})
+	}
+	// types of the entries seen so far, by path
+	seen := make(map[string]byte)
+	// targets of the symlinks that would be extracted so far, by path
+	links := make(map[string]string)
+	// parent directories of the entries seen so far
+	parents := make(map[string]struct{})
+	for {
+		hdr, err := tr.Next()
+		switch err {
+		case io.EOF:
+			return issues, nil
+		case nil:
+		default:
+			return issues, fmt.Errorf("error reading tarball: %w", err)
+		}
+		if opts.NormalizeSeparators {
+			hdr = normalizeSeparators(hdr)
+		}
+		if err := checkName(hdr); err != nil {
+			report(hdr, IssueInvalidPath, err)
+			continue
+		}
+		if opts.Whitelist != nil && !opts.Whitelist.Match(filepath.Clean(hdr.Name)) {
+			continue
+		}
+		orig := hdr
+		hdr, ok, err := opts.relocate(hdr)
+		if err != nil {
+			report(orig, IssueInvalidPath, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if !supportedType(hdr.Typeflag) {
+			report(hdr, IssueUnsupportedType, fmt.Errorf("%w: %v", ErrUnsupportedType, hdr.Typeflag))
+		}
+		name := filepath.Clean(hdr.Name)
+		if err := checkEntry(hdr, opts); err != nil {
+			report(hdr, issueCategory(err), err)
+		} else if err := checkLinkedParents(links, name); err != nil {
+			report(hdr, IssueInsecureLink, err)
+		} else if hdr.Typeflag == tar.TypeLink {
+			if err := checkLinkedParents(links, filepath.Clean(hdr.Linkname)); err != nil {
+				report(hdr, IssueInsecureLink, err)
+			}
+		}
+		if err := recordParents(parents, hdr); err != nil {
+			report(hdr, IssuePathConflict, err)
+		} else if err := checkFileParents(seen, name); err != nil {
+			report(hdr, IssuePathConflict, err)
+		}
+		if typ, ok := seen[name]; ok && !(typ == tar.TypeDir && hdr.Typeflag == tar.TypeDir) {
+			report(hdr, IssueDuplicateEntry, fmt.Errorf("duplicate entry %q", name))
+		}
+		seen[name] = hdr.Typeflag
+		if hdr.Typeflag == tar.TypeSymlink {
+			links[name] = hdr.Linkname
+		} else {
+			delete(links, name)
+		}
+	}
+}
+
+// issueCategory returns the category of the issue for err, returned by
+// checkEntry
+func issueCategory(err error) TarIssueCategory {
+	switch {
+	case errors.Is(err, ErrPathEscape):
+		return IssuePathTraversal
+	case errors.Is(err, ErrInsecureLink):
+		return IssueInsecureLink
+	}
+	return IssueInvalidPath
+}
+
+// checkFileParents returns an error wrapping ErrPathConflict if one of the
+// parents of name is an entry of seen, types by path, that is neither a
+// directory nor a symlink, which checkLinkedParents follows
+func checkFileParents(seen map[string]byte, name string) error {
+	for d := filepath.Dir(name); d != "."; d = filepath.Dir(d) {
+		if typ, ok := seen[d]; ok && typ != tar.TypeDir && typ != tar.TypeSymlink {
+			return fmt.Errorf("%w: %q is the entry of a file, not a directory", ErrPathConflict, d)
+		}
+	}
+	return nil
+}
+
+// checkLinkedParents returns an error wrapping ErrInsecureLink if the parent
+// directory of name resolves outside of the root of the tarball once the
+// symlinks of links, targets by path, are followed. This is what checkParents
+// catches for the symlinks already extracted.
+func checkLinkedParents(links map[string]string, name string) error {
+	// The components left to resolve, and the resolved ones
+	todo := splitPath(filepath.Dir(name))
+	var resolved []string
+	for hops := 0; len(todo) > 0; {
+		c := todo[0]
+		todo = todo[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return fmt.Errorf("%w in path %q: %q resolves outside of the destination", ErrInsecureLink, name, filepath.Dir(name))
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		target, ok := links[filepath.Join(append(resolved, c)...)]
+		if !ok {
+			resolved = append(resolved, c)
+			continue
+		}
+		if hops++; hops > 255 {
+			return fmt.Errorf("%w in path %q: too many levels of symlinks", ErrInsecureLink, name)
+		}
+		if filepath.IsAbs(target) {
+			return fmt.Errorf("%w in path %q: %q resolves to %q", ErrInsecureLink, name, filepath.Join(append(resolved, c)...), target)
+		}
+		todo = append(strings.Split(target, "/"), todo...)
+	}
+	return nil
+}
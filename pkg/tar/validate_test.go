@@ -0,0 +1,231 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidateTar(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/symlink.txt",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/../../secret.conf",
+				Typeflag: tar.TypeReg,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link.txt",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "../../etc/passwd",
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/hardlink.txt",
+				Typeflag: tar.TypeLink,
+				Linkname: "../etc/passwd",
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "./folder/foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/cont",
+				Typeflag: tar.TypeCont,
+			},
+		},
+	}
+	issues, err := ValidateTar(newTestTarReader(t, entries), ExtractTarOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []struct {
+		path     string
+		category TarIssueCategory
+	}{
+		{"../secret.conf", IssuePathTraversal},
+		{"folder/link.txt", IssueInsecureLink},
+		{"folder/hardlink.txt", IssueInsecureLink},
+		{"folder/foo.txt", IssueDuplicateEntry},
+		{"folder/cont", IssueUnsupportedType},
+	}
+	if len(issues) != len(want) {
+		t.Fatalf("unexpected issues: %+v", issues)
+	}
+	for i, w := range want {
+		if issues[i].Path != w.path || issues[i].Category != w.category {
+			t.Errorf("unexpected issue %+v, wanted %s for %q", issues[i], w.category, w.path)
+		}
+	}
+}
+
+func TestValidateTarAsExtraction(t *testing.T) {
+	outside := newTestDir(t)
+	defer os.RemoveAll(outside)
+	// l2 resolves to the parent of the destination, through l
+	parentLinks := []*testTarEntry{
+		{header: &tar.Header{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "."}},
+		{header: &tar.Header{Name: "l2", Typeflag: tar.TypeSymlink, Linkname: "l/.."}},
+	}
+	tests := []struct {
+		entries []*testTarEntry
+		ok      bool
+	}{
+		{
+			entries: []*testTarEntry{
+				{header: &tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}},
+				{header: &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir"}},
+				{contents: "foo", header: &tar.Header{Name: "link/foo.txt", Size: 3, Mode: 0644}},
+			},
+			ok: true,
+		},
+		{
+			entries: append(parentLinks[:2:2],
+				&testTarEntry{contents: "foo", header: &tar.Header{Name: "l2/foo.txt", Size: 3, Mode: 0644}}),
+		},
+		{
+			entries: append(parentLinks[:2:2],
+				&testTarEntry{header: &tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "l2/foo.txt"}}),
+		},
+		{
+			entries: []*testTarEntry{
+				{header: &tar.Header{Name: "abs", Typeflag: tar.TypeSymlink, Linkname: outside}},
+				{contents: "foo", header: &tar.Header{Name: "abs/foo.txt", Size: 3, Mode: 0644}},
+			},
+		},
+		{
+			entries: []*testTarEntry{
+				{header: &tar.Header{Name: "long", Typeflag: tar.TypeSymlink, Linkname: strings.Repeat("a/", DefaultMaxLinkLength)}},
+			},
+		},
+		{
+			entries: []*testTarEntry{
+				{contents: "foo", header: &tar.Header{Name: "/foo.txt", Size: 3, Mode: 0644}},
+			},
+		},
+	}
+	for i, tt := range tests {
+		issues, err := ValidateTar(newTestTarReader(t, tt.entries), ExtractTarOptions{})
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if tt.ok && len(issues) > 0 {
+			t.Errorf("#%d: unexpected issues: %+v", i, issues)
+		}
+		if !tt.ok && len(issues) == 0 {
+			t.Errorf("#%d: expected issues", i)
+		}
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		err = ExtractTarWithOptions(newTestTarReader(t, tt.entries), tmpdir, ExtractTarOptions{})
+		if tt.ok && err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("#%d: expected error", i)
+		}
+	}
+}
+
+func TestValidateTarNormalizeSeparators(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     `..\..\etc\x`,
+				Typeflag: tar.TypeReg,
+			},
+		},
+	}
+	opts := ExtractTarOptions{NormalizeSeparators: true}
+	issues, err := ValidateTar(newTestTarReader(t, entries), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(issues) != 1 || issues[0].Category != IssuePathTraversal || issues[0].Path != "../../etc/x" {
+		t.Errorf("unexpected issues: %+v", issues)
+	}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestValidateTarPathConflict(t *testing.T) {
+	tests := [][]*testTarEntry{
+		{
+			{contents: "foo", header: &tar.Header{Name: "foo", Size: 3, Mode: 0644}},
+			{contents: "bar", header: &tar.Header{Name: "foo/bar", Size: 3, Mode: 0644}},
+		},
+		{
+			{contents: "bar", header: &tar.Header{Name: "foo/bar", Size: 3, Mode: 0644}},
+			{contents: "foo", header: &tar.Header{Name: "foo", Size: 3, Mode: 0644}},
+		},
+	}
+	for i, entries := range tests {
+		issues, err := ValidateTar(newTestTarReader(t, entries), ExtractTarOptions{})
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if len(issues) != 1 || issues[0].Category != IssuePathConflict {
+			t.Errorf("#%d: unexpected issues: %+v", i, issues)
+		}
+		tmpdir := newTestDir(t)
+		defer os.RemoveAll(tmpdir)
+		err = ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, ExtractTarOptions{})
+		if !errors.Is(err, ErrPathConflict) {
+			t.Errorf("#%d: expected ErrPathConflict, got: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MismatchKind says how a file differs from the entry it was extracted from
+type MismatchKind int
+
+const (
+	// MismatchMissing is for entries whose file does not exist
+	MismatchMissing MismatchKind = iota
+	// MismatchType is for files of another type than their entry
+	MismatchType
+	// MismatchSize is for regular files of another size than their entry
+	MismatchSize
+	// MismatchMode is for files whose permissions differ from the ones
+	// their entry is extracted with
+	MismatchMode
+	// MismatchLinkTarget is for symlinks pointing elsewhere than their
+	// entry, and hardlinks not linked to their target
+	MismatchLinkTarget
+)
+
+func (k MismatchKind) String() string {
+	switch k {
+	case MismatchMissing:
+		return "missing"
+	case MismatchType:
+		return "type"
+	case MismatchSize:
+		return "size"
+	case MismatchMode:
+		return "mode"
+	case MismatchLinkTarget:
+		return "link target"
+	}
+	return fmt.Sprintf("MismatchKind(%d)", int(k))
+}
+
+// Mismatch describes a file that differs from the entry it was extracted from
+type Mismatch struct {
+	// Path is the cleaned path of the file, relative to the destination
+	// directory
+	Path    string
+	Kind    MismatchKind
+	Message string
+}
+
+// VerifyExtracted reads the tarball from tr, already extracted into dir with
+// opts, and reports the files that are missing or differ from their entry in
+// type, size, mode or link target, sorted by path. The entries skipped by the
+// whitelist, the exclusions and the other options are not checked. When a
+// path appears more than once, its last entry is checked, as it is the one
+// the extraction leaves. The error is only set when the tarball cannot be
+// read.
+func VerifyExtracted(tr *tar.Reader, dir string, opts ExtractTarOptions) ([]Mismatch, error) {
+	dir, err := resolveDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying tarball: %w", err)
+	}
+	// last entry of each path
+	entries := make(map[string]*tar.Header)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading tarball: %w", err)
+		}
+		if opts.NormalizeSeparators {
+			hdr = normalizeSeparators(hdr)
+		}
+		if checkName(hdr) != nil {
+			continue
+		}
+		if opts.Whitelist != nil && !opts.Whitelist.Match(filepath.Clean(hdr.Name)) {
+			continue
+		}
+		hdr, ok, err := opts.relocate(hdr)
+		if err != nil || !ok {
+			continue
+		}
+		name := filepath.Clean(hdr.Name)
+		if opts.ApplyWhiteouts && isWhiteout(hdr) {
+			// Opaque whiteouts only remove what was there before
+			if base := filepath.Base(name); base != whiteoutOpaque {
+				removed := filepath.Join(filepath.Dir(name), strings.TrimPrefix(base, whiteoutPrefix))
+				for n := range entries {
+					if n == removed || strings.HasPrefix(n, removed+string(filepath.Separator)) {
+						delete(entries, n)
+					}
+				}
+			}
+			continue
+		}
+		if !opts.typeAllowed(hdr.Typeflag) || (opts.SkeletonOnly && hdr.Typeflag != tar.TypeDir) {
+			continue
+		}
+		entries[name] = hdr
+	}
+
+	var mismatches []Mismatch
+	for name, hdr := range entries {
+		if m := verifyEntry(dir, name, hdr, opts); m != nil {
+			mismatches = append(mismatches, *m)
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		return mismatches[i].Path < mismatches[j].Path
+	})
+	return mismatches, nil
+}
+
+// verifyEntry compares the file extracted into dir from the entry described
+// by hdr, of cleaned name name, to the entry
+func verifyEntry(dir, name string, hdr *tar.Header, opts ExtractTarOptions) *Mismatch {
+	mismatch := func(kind MismatchKind, format string, args ...interface{}) *Mismatch {
+		return &Mismatch{Path: name, Kind: kind, Message: fmt.Sprintf(format, args...)}
+	}
+	typ := hdr.Typeflag
+	p := filepath.Join(dir, name)
+	fi, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		// Skipped by the extraction
+		if (typ == tar.TypeChar || typ == tar.TypeBlock) && opts.SkipDevices && os.Geteuid() != 0 {
+			return nil
+		}
+		return mismatch(MismatchMissing, "%q does not exist", p)
+	}
+	if err != nil {
+		return mismatch(MismatchMissing, "%v", err)
+	}
+
+	if typ == tar.TypeLink {
+		target := filepath.Join(dir, filepath.Clean(hdr.Linkname))
+		tfi, err := os.Lstat(target)
+		switch {
+		case err != nil:
+			return mismatch(MismatchLinkTarget, "%v", err)
+		case opts.FlattenHardlinks && !fi.Mode().IsRegular():
+			return mismatch(MismatchType, "expected a regular file, got a %s", fileTypeName(fi.Mode()))
+		case opts.FlattenHardlinks && fi.Size() != tfi.Size():
+			return mismatch(MismatchSize, "expected %d bytes, got %d", tfi.Size(), fi.Size())
+		case !opts.FlattenHardlinks && !os.SameFile(fi, tfi):
+			return mismatch(MismatchLinkTarget, "%q is not linked to %q", p, target)
+		}
+		return nil
+	}
+
+	want, ok := entryFileType(typ)
+	if !ok {
+		return nil
+	}
+	if fi.Mode().Type() != want {
+		return mismatch(MismatchType, "expected a %s, got a %s", fileTypeName(want), fileTypeName(fi.Mode()))
+	}
+	switch typ {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		if fi.Size() != hdr.Size {
+			return mismatch(MismatchSize, "expected %d bytes, got %d", hdr.Size, fi.Size())
+		}
+	case tar.TypeSymlink:
+		want := hdr.Linkname
+		if opts.RebaseAbsoluteLinks && filepath.IsAbs(want) {
+			want = rebaseLink(hdr.Name, want)
+		}
+		got, err := os.Readlink(p)
+		if err != nil {
+			return mismatch(MismatchLinkTarget, "%v", err)
+		}
+		if got != want {
+			return mismatch(MismatchLinkTarget, "expected link to %q, got %q", want, got)
+		}
+		// Symlinks have no mode of their own
+		return nil
+	}
+	meta, err := opts.metadata(hdr)
+	if err != nil {
+		return mismatch(MismatchMode, "%v", err)
+	}
+	if want, got := meta.perm, fi.Mode()&permBits; got != want {
+		return mismatch(MismatchMode, "expected mode %v, got %v", want, got)
+	}
+	return nil
+}
+
+// entryFileType returns the type bits of the files extracted from entries of
+// type typ, or false if they are not extracted
+func entryFileType(typ byte) (os.FileMode, bool) {
+	switch typ {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		return 0, true
+	case tar.TypeDir:
+		return os.ModeDir, true
+	case tar.TypeSymlink:
+		return os.ModeSymlink, true
+	case tar.TypeChar:
+		return os.ModeDevice | os.ModeCharDevice, true
+	case tar.TypeBlock:
+		return os.ModeDevice, true
+	case tar.TypeFifo:
+		return os.ModeNamedPipe, true
+	}
+	return 0, false
+}
+
+// fileTypeName returns a description of the type of files of mode m
+func fileTypeName(m os.FileMode) string {
+	switch m.Type() {
+	case 0:
+		return "regular file"
+	case os.ModeDir:
+		return "directory"
+	case os.ModeSymlink:
+		return "symlink"
+	case os.ModeDevice | os.ModeCharDevice:
+		return "character device"
+	case os.ModeDevice:
+		return "block device"
+	case os.ModeNamedPipe:
+		return "fifo"
+	case os.ModeSocket:
+		return "socket"
+	}
+	return m.Type().String()
+}
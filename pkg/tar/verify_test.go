@@ -0,0 +1,146 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVerifyExtracted(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "folder/bar.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link",
+				Linkname: "foo.txt",
+				Typeflag: tar.TypeSymlink,
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/hardlink",
+				Linkname: "folder/foo.txt",
+				Typeflag: tar.TypeLink,
+			},
+		},
+		{
+			contents: "baz",
+			header: &tar.Header{
+				Name: "skipped.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+	}
+	opts := ExtractTarOptions{Exclude: []string{"skipped.txt"}}
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mismatches, err := VerifyExtracted(newTestTarReader(t, entries), tmpdir, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mismatches) != 0 {
+		t.Errorf("unexpected mismatches: %v", mismatches)
+	}
+
+	if err := os.Truncate(filepath.Join(tmpdir, "folder/bar.txt"), 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Chmod(filepath.Join(tmpdir, "folder"), 0700); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Remove(filepath.Join(tmpdir, "folder/link")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Symlink("bar.txt", filepath.Join(tmpdir, "folder/link")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Replacing the file breaks the hardlink
+	if err := os.Remove(filepath.Join(tmpdir, "folder/foo.txt")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(tmpdir, "folder/foo.txt"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mismatches, err = VerifyExtracted(newTestTarReader(t, entries), tmpdir, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	kinds := make(map[string]MismatchKind)
+	for _, m := range mismatches {
+		got = append(got, m.Path)
+		kinds[m.Path] = m.Kind
+	}
+	want := map[string]MismatchKind{
+		"folder":          MismatchMode,
+		"folder/bar.txt":  MismatchSize,
+		"folder/foo.txt":  MismatchType,
+		"folder/hardlink": MismatchLinkTarget,
+		"folder/link":     MismatchLinkTarget,
+	}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("unexpected mismatches: %v", mismatches)
+	}
+	wantOrder := []string{"folder", "folder/bar.txt", "folder/foo.txt", "folder/hardlink", "folder/link"}
+	if !reflect.DeepEqual(got, wantOrder) {
+		t.Errorf("unexpected order %v, wanted %v", got, wantOrder)
+	}
+
+	if err := os.RemoveAll(filepath.Join(tmpdir, "folder")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mismatches, err = VerifyExtracted(newTestTarReader(t, entries), tmpdir, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, m := range mismatches {
+		if m.Kind != MismatchMissing {
+			t.Errorf("%s: unexpected mismatch %v, wanted %v", m.Path, m.Kind, MismatchMissing)
+		}
+	}
+	if len(mismatches) != 5 {
+		t.Errorf("unexpected mismatches: %v", mismatches)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SkipEntry can be returned by a WalkFunc to move on to the next entry without
+// reading the rest of the content of the current one.
+var SkipEntry = errors.New("skip this entry")
+
+// WalkFunc is called by WalkTar for each entry of a tarball, with a reader of
+// its content that is only valid until the function returns. If it returns an
+// error other than SkipEntry, WalkTar stops and returns that error.
+type WalkFunc func(hdr *tar.Header, r io.Reader) error
+
+// WalkTar calls fn for each entry of a tarball (from a tar.Reader), in archive
+// order, without extracting anything.
+func WalkTar(tr *tar.Reader, fn WalkFunc) error {
+	for {
+		hdr, err := tr.Next()
+		switch err {
+		case io.EOF:
+			return nil
+		case nil:
+			// The tar reader skips whatever is left of the content
+			// of an entry when advancing to the next one
+			if err := fn(hdr, io.LimitReader(tr, hdr.Size)); err != nil && err != SkipEntry {
+				return err
+			}
+		default:
+			return fmt.Errorf("error reading tarball: %w", err)
+		}
+	}
+}
+
+// ListTar returns the FileInfo of each entry of a tarball (from a tar.Reader),
+// directories included, in archive order, without extracting anything. The
+// Sys method of each FileInfo returns the *tar.Header of the entry.
+func ListTar(tr *tar.Reader) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	err := WalkTar(tr, func(hdr *tar.Header, r io.Reader) error {
+		infos = append(infos, hdr.FileInfo())
+		return SkipEntry
+	})
+	return infos, err
+}
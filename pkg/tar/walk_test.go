@@ -0,0 +1,131 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWalkTar(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "foo.txt",
+				Size: 3,
+			},
+		},
+		{
+			contents: "skipped",
+			header: &tar.Header{
+				Name: "skipped.txt",
+				Size: 7,
+			},
+		},
+		{
+			contents: "bar",
+			header: &tar.Header{
+				Name: "bar.txt",
+				Size: 3,
+			},
+		},
+	}
+	contents := make(map[string]string)
+	err := WalkTar(newTestTarReader(t, entries), func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Name == "skipped.txt" {
+			return SkipEntry
+		}
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		contents[hdr.Name] = string(buf)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(contents) != 2 || contents["foo.txt"] != "foo" || contents["bar.txt"] != "bar" {
+		t.Errorf("unexpected contents: %v", contents)
+	}
+
+	stop := errors.New("stop")
+	var n int
+	err = WalkTar(newTestTarReader(t, entries), func(hdr *tar.Header, r io.Reader) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("unexpected error %v after %d entries", err, n)
+	}
+}
+
+func TestListTar(t *testing.T) {
+	entries := []*testTarEntry{
+		{
+			header: &tar.Header{
+				Name:     "folder/",
+				Typeflag: tar.TypeDir,
+				Mode:     int64(0755),
+			},
+		},
+		{
+			contents: "foo",
+			header: &tar.Header{
+				Name: "folder/foo.txt",
+				Size: 3,
+				Mode: int64(0644),
+			},
+		},
+		{
+			header: &tar.Header{
+				Name:     "folder/link",
+				Typeflag: tar.TypeSymlink,
+				Linkname: "foo.txt",
+				Mode:     int64(0777),
+			},
+		},
+	}
+	infos, err := ListTar(newTestTarReader(t, entries))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []struct {
+		name string
+		size int64
+		mode os.FileMode
+	}{
+		{"folder", 0, os.ModeDir | 0755},
+		{"foo.txt", 3, 0644},
+		{"link", 0, os.ModeSymlink | 0777},
+	}
+	if len(infos) != len(want) {
+		t.Fatalf("unexpected number of entries: %d, wanted %d", len(infos), len(want))
+	}
+	for i, w := range want {
+		fi := infos[i]
+		if fi.Name() != w.name || fi.Size() != w.size || fi.Mode() != w.mode {
+			t.Errorf("unexpected entry %s %d %v, wanted %s %d %v", fi.Name(), fi.Size(), fi.Mode(), w.name, w.size, w.mode)
+		}
+		if hdr, ok := fi.Sys().(*tar.Header); !ok || hdr.Name != entries[i].header.Name {
+			t.Errorf("unexpected Sys %v", fi.Sys())
+		}
+	}
+}
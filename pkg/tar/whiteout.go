@@ -0,0 +1,114 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// whiteoutPrefix prefixes the names of the entries whiting out the
+	// path with the rest of their name
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque is the name of the entries whiting out the content of
+	// their directory
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// isWhiteout returns whether hdr describes a whiteout
+func isWhiteout(hdr *tar.Header) bool {
+	return strings.HasPrefix(filepath.Base(hdr.Name), whiteoutPrefix)
+}
+
+// applyWhiteout removes what the whiteout described by hdr whites out from
+// the destination directory
+func (x *extraction) applyWhiteout(hdr *tar.Header) error {
+	if err := x.whiteout(hdr); err != nil {
+		return fmt.Errorf("error extracting tarball: %w", &EntryError{Path: hdr.Name, Err: err})
+	}
+	return nil
+}
+
+func (x *extraction) whiteout(hdr *tar.Header) error {
+	if err := checkPath(hdr); err != nil {
+		return err
+	}
+	name := filepath.Clean(hdr.Name)
+	p := filepath.Join(x.dir, name)
+	// Removing through a symlink would remove outside of the destination
+	if err := checkParents(x.dir, p); err != nil {
+		return err
+	}
+	// Pending files may be what is removed
+	if x.pool != nil {
+		if err := x.pool.wait(); err != nil {
+			return err
+		}
+	}
+	base := filepath.Base(name)
+	if base == whiteoutOpaque {
+		return x.clearOpaque(filepath.Dir(name))
+	}
+	target := strings.TrimPrefix(base, whiteoutPrefix)
+	if target == "" || target == "." || target == ".." {
+		return fmt.Errorf("invalid whiteout %q", hdr.Name)
+	}
+	return os.RemoveAll(filepath.Join(filepath.Dir(p), target))
+}
+
+// clearOpaque removes the content of the directory dir, relative to the
+// destination directory, except what this extraction extracted
+func (x *extraction) clearOpaque(dir string) error {
+	children, err := ioutil.ReadDir(filepath.Join(x.dir, dir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		name := filepath.Join(dir, c.Name())
+		if _, ok := x.layer[name]; !ok {
+			if err := os.RemoveAll(filepath.Join(x.dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		// Directories of this layer may have been merged with the ones
+		// already there
+		if c.IsDir() {
+			if err := x.clearOpaque(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addToLayer records that name, and thus its parent directories, are
+// extracted by this extraction
+func (x *extraction) addToLayer(name string) {
+	if x.layer == nil {
+		x.layer = make(map[string]struct{})
+	}
+	for name = filepath.Clean(name); name != "."; name = filepath.Dir(name) {
+		x.layer[name] = struct{}{}
+	}
+}
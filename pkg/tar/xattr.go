@@ -0,0 +1,76 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// paxXattrPrefix prefixes the PAX records holding extended attributes
+const paxXattrPrefix = "SCHILY.xattr."
+
+// capabilityXattr is the extended attribute holding the file capabilities
+const capabilityXattr = "security.capability"
+
+// restoreXattrs sets the extended attributes recorded in hdr on p, without
+// following symlinks. When not running as root, failing to set an attribute
+// outside of the security namespace is only a warning. So is failing to set
+// the file capabilities for lack of CAP_SETFCAP, whoever runs.
+func restoreXattrs(p string, hdr *tar.Header, opts ExtractTarOptions) error {
+	for k, v := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, paxXattrPrefix) {
+			continue
+		}
+		attr := strings.TrimPrefix(k, paxXattrPrefix)
+		if err := lsetxattr(p, attr, []byte(v)); err != nil {
+			if attr == capabilityXattr && err == syscall.EPERM {
+				opts.warn(p, fmt.Errorf("not setting capabilities of %q: %v", p, err))
+				continue
+			}
+			if os.Geteuid() != 0 && !strings.HasPrefix(attr, "security.") {
+				opts.warn(p, fmt.Errorf("unable to set xattr %q on %q: %v", attr, p, err))
+				continue
+			}
+			return fmt.Errorf("error setting xattr %q on %q: %v", attr, p, err)
+		}
+	}
+	return nil
+}
+
+// lsetxattr is like syscall.Setxattr, but does not follow symlinks
+func lsetxattr(path string, attr string, data []byte) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+	var d unsafe.Pointer
+	if len(data) > 0 {
+		d = unsafe.Pointer(&data[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(a)), uintptr(d), uintptr(len(data)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
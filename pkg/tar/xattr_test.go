@@ -0,0 +1,120 @@
+// Copyright 2014 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestExtractTarXattrs(t *testing.T) {
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+	if err := syscall.Setxattr(tmpdir, "user.rkt", []byte("test"), 0); err != nil {
+		t.Skipf("user xattrs not supported: %v", err)
+	}
+
+	entries := []*testTarEntry{
+		{
+			contents: "hello",
+			header: &tar.Header{
+				Name: "hello.txt",
+				Size: 5,
+				PAXRecords: map[string]string{
+					"SCHILY.xattr.user.foo": "bar",
+				},
+			},
+		},
+	}
+	opts := ExtractTarOptions{RestoreXattrs: true}
+	if err := ExtractTarWithOptions(newTestTarReader(t, entries), tmpdir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf := make([]byte, 16)
+	n, err := syscall.Getxattr(filepath.Join(tmpdir, "hello.txt"), "user.foo", buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf[:n]) != "bar" {
+		t.Errorf("unexpected xattr value, wanted: %s, got: %s", "bar", buf[:n])
+	}
+}
+
+func TestExtractTarCapabilities(t *testing.T) {
+	tmpdir := newTestDir(t)
+	defer os.RemoveAll(tmpdir)
+
+	// A vfs_cap_data of revision 2 with CAP_NET_RAW permitted and effective
+	caps := string([]byte{
+		0x01, 0x00, 0x00, 0x02,
+		0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	})
+	entries := []*testTarEntry{
+		{
+			contents: "ping",
+			header: &tar.Header{
+				Name: "bin/ping",
+				Size: 4,
+				Mode: 0755,
+				PAXRecords: map[string]string{
+					"SCHILY.xattr.security.capability": caps,
+				},
+			},
+		},
+	}
+	var warned []string
+	opts := ExtractTarOptions{
+		RestoreXattrs: true,
+		OnWarn: func(p string, err error) {
+			warned = append(warned, p)
+		},
+	}
+	if os.Geteuid() == 0 {
+		if err := ExtractTarWithOptions(newTestTarReader(t, entries), filepath.Join(tmpdir, "root"), opts); err != nil {
+			t.Skipf("capabilities not supported: %v", err)
+		}
+		buf := make([]byte, 64)
+		n, err := syscall.Getxattr(filepath.Join(tmpdir, "root/bin/ping"), "security.capability", buf)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf[:n]) != caps {
+			t.Errorf("unexpected capabilities, wanted: %x, got: %x", caps, buf[:n])
+		}
+
+		if err := os.Chmod(tmpdir, 0777); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := syscall.Setreuid(-1, 65534); err != nil {
+			t.Skipf("unable to drop root: %v", err)
+		}
+	}
+	err := ExtractTarWithOptions(newTestTarReader(t, entries), filepath.Join(tmpdir, "unprivileged"), opts)
+	if os.Getuid() == 0 {
+		if err := syscall.Setreuid(-1, 0); err != nil {
+			t.Fatalf("unable to restore root: %v", err)
+		}
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := filepath.Join(tmpdir, "unprivileged/bin/ping"); len(warned) != 1 || warned[0] != want {
+		t.Errorf("unexpected warnings for %v, wanted %v", warned, want)
+	}
+}